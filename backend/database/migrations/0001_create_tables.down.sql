@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS connections;
+DROP TABLE IF EXISTS user_bios;
+DROP TABLE IF EXISTS profiles;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,9 @@
+-- Rows created before connection requests existed were instant
+-- connections, so they are backfilled as accepted before new rows
+-- default to pending.
+ALTER TABLE connections
+	ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'accepted',
+	ADD COLUMN IF NOT EXISTS responded_at TIMESTAMPTZ;
+
+ALTER TABLE connections
+	ALTER COLUMN status SET DEFAULT 'pending';
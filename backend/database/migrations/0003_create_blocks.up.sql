@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS blocks (
+	blocker_id INTEGER REFERENCES users(id),
+	blocked_id INTEGER REFERENCES users(id),
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY(blocker_id, blocked_id)
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
+
+-- Every refresh token belongs to the session (token family) it was issued
+-- for. Tokens are single-use: presenting a used one revokes the session.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+	token_hash TEXT UNIQUE NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	used_at TIMESTAMPTZ
+);
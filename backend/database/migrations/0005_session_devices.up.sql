@@ -0,0 +1,4 @@
+ALTER TABLE sessions
+	ADD COLUMN IF NOT EXISTS user_agent TEXT,
+	ADD COLUMN IF NOT EXISTS ip TEXT,
+	ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ DEFAULT NOW();
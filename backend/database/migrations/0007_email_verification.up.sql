@@ -0,0 +1,11 @@
+-- Accounts registered before verification existed are grandfathered in as
+-- verified before new accounts default to unverified.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT true;
+
+ALTER TABLE users
+	ALTER COLUMN email_verified SET DEFAULT false;
+
+-- Emails are unique regardless of case. This fails if existing rows only
+-- differ by case, which has to be resolved by hand.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (LOWER(email));
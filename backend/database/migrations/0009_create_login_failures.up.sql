@@ -0,0 +1,7 @@
+-- Failed login attempts keyed by "account:<email>" or "ip:<address>".
+CREATE TABLE IF NOT EXISTS login_failures (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMPTZ DEFAULT NOW(),
+	locked_until TIMESTAMPTZ
+);
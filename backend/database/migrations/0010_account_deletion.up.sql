@@ -0,0 +1,41 @@
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ;
+
+-- Deleting a user row erases everything that belongs to them.
+ALTER TABLE profiles
+	DROP CONSTRAINT IF EXISTS profiles_user_id_fkey,
+	ADD CONSTRAINT profiles_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE user_bios
+	DROP CONSTRAINT IF EXISTS user_bios_user_id_fkey,
+	ADD CONSTRAINT user_bios_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE connections
+	DROP CONSTRAINT IF EXISTS connections_user_id_1_fkey,
+	DROP CONSTRAINT IF EXISTS connections_user_id_2_fkey,
+	ADD CONSTRAINT connections_user_id_1_fkey FOREIGN KEY (user_id_1) REFERENCES users(id) ON DELETE CASCADE,
+	ADD CONSTRAINT connections_user_id_2_fkey FOREIGN KEY (user_id_2) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE messages
+	DROP CONSTRAINT IF EXISTS messages_connection_id_fkey,
+	DROP CONSTRAINT IF EXISTS messages_sender_id_fkey,
+	ADD CONSTRAINT messages_connection_id_fkey FOREIGN KEY (connection_id) REFERENCES connections(id) ON DELETE CASCADE,
+	ADD CONSTRAINT messages_sender_id_fkey FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE blocks
+	DROP CONSTRAINT IF EXISTS blocks_blocker_id_fkey,
+	DROP CONSTRAINT IF EXISTS blocks_blocked_id_fkey,
+	ADD CONSTRAINT blocks_blocker_id_fkey FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+	ADD CONSTRAINT blocks_blocked_id_fkey FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE sessions
+	DROP CONSTRAINT IF EXISTS sessions_user_id_fkey,
+	ADD CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE password_resets
+	DROP CONSTRAINT IF EXISTS password_resets_user_id_fkey,
+	ADD CONSTRAINT password_resets_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE recovery_codes
+	DROP CONSTRAINT IF EXISTS recovery_codes_user_id_fkey,
+	ADD CONSTRAINT recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
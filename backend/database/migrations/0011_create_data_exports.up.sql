@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS data_exports (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status TEXT NOT NULL DEFAULT 'pending',
+	archive BYTEA,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	completed_at TIMESTAMPTZ,
+	expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports(user_id);
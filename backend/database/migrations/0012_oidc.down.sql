@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS user_identities;
+
+-- Fails if social-login accounts without a password exist.
+ALTER TABLE users
+	ALTER COLUMN password SET NOT NULL;
@@ -0,0 +1,26 @@
+-- Accounts created through a social login have no password until the
+-- user sets one with the password reset flow.
+ALTER TABLE users
+	ALTER COLUMN password DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	email TEXT,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	UNIQUE(provider, subject),
+	UNIQUE(user_id, provider)
+);
+
+-- In-flight authorization requests. user_id is set when an existing
+-- account is linking a provider rather than logging in.
+CREATE TABLE IF NOT EXISTS oidc_states (
+	state_hash TEXT PRIMARY KEY,
+	provider TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL
+);
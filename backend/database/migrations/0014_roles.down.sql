@@ -0,0 +1,3 @@
+ALTER TABLE users
+	DROP COLUMN IF EXISTS state,
+	DROP COLUMN IF EXISTS role;
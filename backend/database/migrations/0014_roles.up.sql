@@ -0,0 +1,5 @@
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+		CHECK (role IN ('user', 'moderator', 'admin')),
+	ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'active'
+		CHECK (state IN ('active', 'suspended'));
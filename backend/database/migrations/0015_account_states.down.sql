@@ -0,0 +1,9 @@
+ALTER TABLE messages
+	DROP COLUMN IF EXISTS hidden;
+
+UPDATE users SET state = 'active' WHERE state IN ('shadow_banned', 'deactivated');
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS suspended_until,
+	DROP CONSTRAINT IF EXISTS users_state_check,
+	ADD CONSTRAINT users_state_check CHECK (state IN ('active', 'suspended'));
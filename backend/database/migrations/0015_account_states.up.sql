@@ -0,0 +1,10 @@
+-- suspended_until is NULL for indefinite suspensions.
+ALTER TABLE users
+	DROP CONSTRAINT IF EXISTS users_state_check,
+	ADD CONSTRAINT users_state_check
+		CHECK (state IN ('active', 'suspended', 'shadow_banned', 'deactivated')),
+	ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMPTZ;
+
+-- Messages sent while shadow-banned are only shown to their sender.
+ALTER TABLE messages
+	ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT false;
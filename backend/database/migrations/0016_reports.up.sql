@@ -0,0 +1,30 @@
+-- Reports keep a snapshot of the reported content, and survive the
+-- reported user deleting their account, so evidence cannot be erased.
+CREATE TABLE IF NOT EXISTS reports (
+	id SERIAL PRIMARY KEY,
+	reporter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	target_type TEXT NOT NULL CHECK (target_type IN ('user', 'profile', 'message')),
+	reported_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	message_id INTEGER,
+	reason TEXT NOT NULL,
+	details TEXT NOT NULL DEFAULT '',
+	snapshot JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'open'
+		CHECK (status IN ('open', 'triaged', 'actioned', 'dismissed')),
+	assignee_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports(status, created_at);
+CREATE INDEX IF NOT EXISTS reports_reported_user_id_idx ON reports(reported_user_id);
+
+CREATE TABLE IF NOT EXISTS report_notes (
+	id SERIAL PRIMARY KEY,
+	report_id INTEGER NOT NULL REFERENCES reports(id) ON DELETE CASCADE,
+	author_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	body TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS report_notes_report_id_idx ON report_notes(report_id);
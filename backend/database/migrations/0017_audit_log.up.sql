@@ -0,0 +1,30 @@
+-- actor_id and target_id are not foreign keys so entries outlive the
+-- accounts they mention.
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	action TEXT NOT NULL,
+	actor_id INTEGER,
+	target_type TEXT,
+	target_id INTEGER,
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	details JSONB NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log(created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_id_idx ON audit_log(actor_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log(target_type, target_id, created_at);
+
+-- Entries are append-only. Old ones may only be deleted by the
+-- retention job.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+	BEFORE UPDATE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
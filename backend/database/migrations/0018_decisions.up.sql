@@ -0,0 +1,12 @@
+-- One decision per pair; deciding again replaces the earlier one.
+CREATE TABLE IF NOT EXISTS decisions (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	target_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	action TEXT NOT NULL CHECK (action IN ('like', 'pass', 'super_like')),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE(user_id, target_id)
+);
+
+CREATE INDEX IF NOT EXISTS decisions_user_id_created_at_idx ON decisions(user_id, created_at);
+CREATE INDEX IF NOT EXISTS decisions_target_id_idx ON decisions(target_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS recommendation_feed_items;
+DROP TABLE IF EXISTS recommendation_feeds;
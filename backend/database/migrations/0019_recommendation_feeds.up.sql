@@ -0,0 +1,19 @@
+-- A feed is a ranked snapshot of recommendations that a user pages
+-- through, so new users or profile edits do not reshuffle it.
+CREATE TABLE IF NOT EXISTS recommendation_feeds (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS recommendation_feeds_expires_at_idx ON recommendation_feeds(expires_at);
+
+CREATE TABLE IF NOT EXISTS recommendation_feed_items (
+	feed_id INTEGER NOT NULL REFERENCES recommendation_feeds(id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	score DOUBLE PRECISION NOT NULL,
+	reasons JSONB NOT NULL DEFAULT '[]',
+	PRIMARY KEY (feed_id, position)
+);
@@ -0,0 +1,4 @@
+-- session_id is set when a signed-in user logs in with a linked provider
+-- again to confirm a sensitive change, rather than to log in or link.
+ALTER TABLE oidc_states
+	ADD COLUMN IF NOT EXISTS session_id INTEGER REFERENCES sessions(id) ON DELETE CASCADE;
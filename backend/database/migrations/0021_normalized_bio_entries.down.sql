@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS profiles_location_idx;
+DROP INDEX IF EXISTS user_bios_looking_for_idx;
+DROP INDEX IF EXISTS user_bios_food_preferences_idx;
+DROP INDEX IF EXISTS user_bios_music_preferences_idx;
+DROP INDEX IF EXISTS user_bios_hobbies_idx;
+DROP INDEX IF EXISTS user_bios_interests_idx;
+
+DROP FUNCTION IF EXISTS normalized_entries(TEXT[]);
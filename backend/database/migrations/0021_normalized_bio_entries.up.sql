@@ -0,0 +1,19 @@
+-- Bio entries are matched ignoring case and surrounding spaces. The
+-- recommendation source filters on these expressions, so they are
+-- indexed.
+CREATE OR REPLACE FUNCTION normalized_entries(entries TEXT[]) RETURNS TEXT[]
+	LANGUAGE sql IMMUTABLE PARALLEL SAFE
+	AS $$
+		SELECT ARRAY(
+			SELECT DISTINCT LOWER(BTRIM(entry))
+			FROM unnest(entries) AS entry
+			WHERE BTRIM(entry) <> ''
+		)
+	$$;
+
+CREATE INDEX IF NOT EXISTS user_bios_interests_idx ON user_bios USING GIN (normalized_entries(interests));
+CREATE INDEX IF NOT EXISTS user_bios_hobbies_idx ON user_bios USING GIN (normalized_entries(hobbies));
+CREATE INDEX IF NOT EXISTS user_bios_music_preferences_idx ON user_bios USING GIN (normalized_entries(music_preferences));
+CREATE INDEX IF NOT EXISTS user_bios_food_preferences_idx ON user_bios USING GIN (normalized_entries(food_preferences));
+CREATE INDEX IF NOT EXISTS user_bios_looking_for_idx ON user_bios USING GIN (normalized_entries(looking_for));
+CREATE INDEX IF NOT EXISTS profiles_location_idx ON profiles (LOWER(BTRIM(location)));
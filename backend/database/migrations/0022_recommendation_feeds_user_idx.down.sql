@@ -0,0 +1 @@
+DROP INDEX IF EXISTS recommendation_feeds_user_id_created_at_idx;
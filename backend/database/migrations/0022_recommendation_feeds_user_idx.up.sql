@@ -0,0 +1,2 @@
+-- GetRecommendations reuses a user's newest live feed.
+CREATE INDEX IF NOT EXISTS recommendation_feeds_user_id_created_at_idx ON recommendation_feeds(user_id, created_at);
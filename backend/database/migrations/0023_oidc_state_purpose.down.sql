@@ -0,0 +1,5 @@
+-- Before purpose, a session_id meant a re-authentication
+DELETE FROM oidc_states WHERE purpose = 'link';
+
+ALTER TABLE oidc_states
+	DROP COLUMN IF EXISTS purpose;
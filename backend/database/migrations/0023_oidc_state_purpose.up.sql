@@ -0,0 +1,10 @@
+-- purpose says whether a state logs in, links a provider or confirms a
+-- sensitive change. Links and re-authentications record the session that
+-- started them, which must also finish them.
+ALTER TABLE oidc_states
+	ADD COLUMN IF NOT EXISTS purpose TEXT NOT NULL DEFAULT 'login';
+
+UPDATE oidc_states SET purpose = 'reauth' WHERE session_id IS NOT NULL;
+
+-- Links started without a session cannot be checked, so they are dropped
+DELETE FROM oidc_states WHERE user_id IS NOT NULL AND session_id IS NULL;
@@ -3,6 +3,7 @@ module match-me
 go 1.21
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.5.1
@@ -10,4 +11,4 @@ require (
 	golang.org/x/crypto v0.21.0
 )
 
-require golang.org/x/net v0.21.0 // indirect
\ No newline at end of file
+require golang.org/x/net v0.21.0 // indirect
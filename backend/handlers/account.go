@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/mailer"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const emailChangeTTL = 24 * time.Hour
+
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	sessionID, _ := getSessionIDFromToken(r)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		ReauthToken     string `json:"reauth_token"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email, ok := reauthenticate(w, r, userID, req.CurrentPassword, req.ReauthToken)
+	if !ok {
+		return
+	}
+
+	if !checkPasswordPolicy(w, req.NewPassword) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password = $1
+		WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID, sessionID); err != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	// As with a reset, scripts have to be given new tokens
+	if err := revokeUserAPITokens(tx, userID); err != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditPasswordChange, userID, auditTargetUser, userID, nil)
+
+	err = Mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Your password was changed",
+		Body: "The password for your account was just changed, your other devices were signed out and your API tokens were revoked.\n\n" +
+			"If it wasn't you, reset your password right away.",
+	})
+	if err != nil {
+		log.Printf("error sending password change notice: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestEmailChange sends a confirmation link to the new address. The
+// email is only changed once ConfirmEmailChange receives that link's token.
+func RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		NewEmail    string `json:"new_email"`
+		Password    string `json:"password"`
+		ReauthToken string `json:"reauth_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email, ok := reauthenticate(w, r, userID, req.Password, req.ReauthToken)
+	if !ok {
+		return
+	}
+
+	newEmail, err := normalizeEmail(req.NewEmail)
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
+	if strings.EqualFold(newEmail, email) {
+		http.Error(w, "That is already your email address", http.StatusBadRequest)
+		return
+	}
+
+	var taken bool
+	err = database.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))
+	`, newEmail).Scan(&taken)
+	if err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+
+	// Binding the link to the current address makes it useless once the
+	// email changes, so it cannot be replayed to undo a later change
+	token, err := signPurposeClaims(userID, &purposeClaims{
+		Email:   newEmail,
+		From:    email,
+		Purpose: "change_email",
+	}, emailChangeTTL)
+	if err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+
+	err = Mailer.Send(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Follow this link within 24 hours to use this address for your account:\n%s",
+			appLink("/confirm-email", token)),
+	})
+	if err != nil {
+		log.Printf("error sending email change confirmation: %v", err)
+		http.Error(w, "Error sending confirmation email", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditEmailChangeRequest, userID, auditTargetUser, userID, map[string]interface{}{
+		"new_email": newEmail,
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	sessionID, _ := getSessionIDFromToken(r)
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tokenUserID, claims, err := parsePurposeClaims(req.Token, "change_email")
+	if err != nil || tokenUserID != userID {
+		http.Error(w, "Invalid or expired confirmation link", http.StatusBadRequest)
+		return
+	}
+	newEmail := claims.Email
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldEmail string
+	err = tx.QueryRow(`SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&oldEmail)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if oldEmail == newEmail {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if oldEmail != claims.From {
+		http.Error(w, "Invalid or expired confirmation link", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET email = $1, email_verified = true
+		WHERE id = $2
+	`, newEmail, userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID, sessionID); err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditEmailChange, userID, auditTargetUser, userID, map[string]interface{}{
+		"old_email": oldEmail,
+		"new_email": newEmail,
+	})
+
+	err = Mailer.Send(mailer.Message{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Body: fmt.Sprintf("The email address for your account was changed to %s and your other devices were signed out.\n\n"+
+			"If it wasn't you, contact support right away.", newEmail),
+	})
+	if err != nil {
+		log.Printf("error sending email change notice: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reauthenticate checks the caller is still userID before a sensitive
+// change. Accounts without a password confirm with the reauth_token from
+// logging in again with a linked provider in this session. It writes the
+// error response and returns false if neither checks out.
+func reauthenticate(w http.ResponseWriter, r *http.Request, userID int, password, reauthToken string) (string, bool) {
+	var email, hash string
+	err := database.DB.QueryRow(`
+		SELECT email, COALESCE(password, '')
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&email, &hash)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return "", false
+	}
+
+	if hash == "" {
+		sessionID, _ := getSessionIDFromToken(r)
+		tokenUserID, claims, err := parsePurposeClaims(reauthToken, "reauth")
+		if err != nil || tokenUserID != userID || claims.SessionID != sessionID {
+			http.Error(w, "Log in with your provider again to confirm", http.StatusUnauthorized)
+			return "", false
+		}
+		return email, true
+	}
+
+	// Guessing the password with a stolen access token is throttled like
+	// logging in, under a key that logging in does not clear
+	keys := []throttleKey{
+		{key: "reauth:" + strconv.Itoa(userID), threshold: accountFailureThreshold},
+		{key: "ip:" + clientIP(r), threshold: ipFailureThreshold},
+	}
+	if wait := checkLoginThrottle(keys); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return "", false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		recordLoginFailure(keys)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+
+	if err := clearLoginFailures(keys[0].key); err != nil {
+		log.Printf("error clearing reauthentication failures: %v", err)
+	}
+
+	return email, true
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func expectPasswordHash(t *testing.T, mock sqlmock.Sqlmock, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SELECT email, COALESCE\\(password, ''\\)").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "password"}).AddRow("user@example.com", string(hash)))
+}
+
+func TestReauthenticatePasswordIsThrottled(t *testing.T) {
+	mock := newMockDB(t)
+	expectPasswordHash(t, mock, "correct horse")
+	mock.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("reauth:5").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+	mock.ExpectQuery("SELECT locked_until FROM login_failures").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(nil))
+
+	// Even the right password is refused while locked
+	w := httptest.NewRecorder()
+	r := withSession(httptest.NewRequest("POST", "/", nil), 5, 7)
+	if _, ok := reauthenticate(w, r, 5, "correct horse", ""); ok {
+		t.Fatal("reauthenticate succeeded while locked")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestReauthenticatePassword(t *testing.T) {
+	t.Run("wrong password counts a failure", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectPasswordHash(t, mock, "correct horse")
+		expectNotThrottled(mock, 2)
+		mock.ExpectQuery("INSERT INTO login_failures").
+			WithArgs("reauth:5", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+		expectLoginFailure(mock, 1)
+
+		w := httptest.NewRecorder()
+		r := withSession(httptest.NewRequest("POST", "/", nil), 5, 7)
+		if _, ok := reauthenticate(w, r, 5, "battery staple", ""); ok {
+			t.Fatal("reauthenticate accepted a wrong password")
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("right password clears failures", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectPasswordHash(t, mock, "correct horse")
+		expectNotThrottled(mock, 2)
+		mock.ExpectExec("DELETE FROM login_failures").
+			WithArgs("reauth:5").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := httptest.NewRecorder()
+		r := withSession(httptest.NewRequest("POST", "/", nil), 5, 7)
+		if _, ok := reauthenticate(w, r, 5, "correct horse", ""); !ok {
+			t.Fatalf("reauthenticate refused the right password: %d", w.Code)
+		}
+	})
+}
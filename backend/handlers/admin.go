@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+var errUnknownRole = errors.New("unknown role")
+
+// SearchUsers lists accounts whose email or name contains q, optionally
+// filtered by role and state, newest first.
+func SearchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > maxAdminPageSize {
+		limit = defaultAdminPageSize
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.email, u.email_verified, u.role, u.state, u.suspended_until, p.name
+		FROM users u
+		LEFT JOIN profiles p ON p.user_id = u.id
+		WHERE ($1 = '' OR u.email ILIKE '%' || $1 || '%' OR p.name ILIKE '%' || $1 || '%')
+		AND ($2 = '' OR u.role = $2)
+		AND ($3 = '' OR u.state = $3)
+		ORDER BY u.id DESC
+		LIMIT $4 OFFSET $5
+	`, escapeLike(query.Get("q")), query.Get("role"), query.Get("state"), limit, offset)
+	if err != nil {
+		http.Error(w, "Error searching users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []map[string]interface{}{}
+	for rows.Next() {
+		var user models.User
+		var name sql.NullString
+		err := rows.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Role, &user.State, &user.SuspendedUntil, &name)
+		if err != nil {
+			http.Error(w, "Error scanning users", http.StatusInternalServerError)
+			return
+		}
+
+		users = append(users, map[string]interface{}{
+			"user": user,
+			"name": name.String,
+		})
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
+// GetAdminUser returns an account with its profile and bio.
+func GetAdminUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = database.DB.QueryRow(`
+		SELECT id, email, email_verified, role, state, suspended_until
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Role, &user.State, &user.SuspendedUntil)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	profile, err := loadProfile(userID)
+	if err != nil {
+		http.Error(w, "Error fetching profile", http.StatusInternalServerError)
+		return
+	}
+
+	bio, err := loadBio(userID)
+	if err != nil {
+		http.Error(w, "Error fetching bio", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":    user,
+		"profile": profile,
+		"bio":     bio,
+	})
+}
+
+// SuspendUser blocks a user from logging in. The body may set "until"
+// to end the suspension at that time; without it the suspension lasts
+// until the user is reactivated.
+func SuspendUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Until *time.Time `json:"until"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Until != nil && !req.Until.After(time.Now()) {
+		http.Error(w, "Suspension must end in the future", http.StatusBadRequest)
+		return
+	}
+
+	setUserState(w, r, models.StateSuspended, req.Until)
+}
+
+// ShadowBanUser hides a user from everyone else without telling them.
+func ShadowBanUser(w http.ResponseWriter, r *http.Request) {
+	setUserState(w, r, models.StateShadowBanned, nil)
+}
+
+func ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	setUserState(w, r, models.StateActive, nil)
+}
+
+// setUserState moves a user to state. Moderators may only act on users
+// whose role is below their own.
+func setUserState(w http.ResponseWriter, r *http.Request, state string, until *time.Time) {
+	adminID, _ := getUserIDFromToken(r)
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if userID == adminID {
+		http.Error(w, "Cannot change your own account state", http.StatusBadRequest)
+		return
+	}
+
+	if !checkOutranks(w, r, userID, "Error updating account") {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error updating account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET state = $1, suspended_until = $2
+		WHERE id = $3
+	`, state, until, userID)
+	if err != nil {
+		http.Error(w, "Error updating account", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if state == models.StateSuspended {
+		if err := revokeUserSessions(tx, userID, 0); err != nil {
+			http.Error(w, "Error updating account", http.StatusInternalServerError)
+			return
+		}
+		if err := revokeUserAPITokens(tx, userID); err != nil {
+			http.Error(w, "Error updating account", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating account", http.StatusInternalServerError)
+		return
+	}
+
+	if state == models.StateSuspended {
+		Manager.DisconnectUser(userID)
+	}
+
+	details := map[string]interface{}{"state": state}
+	if until != nil {
+		details["until"] = until
+	}
+	recordAudit(r, auditAdminSetState, adminID, auditTargetUser, userID, details)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ForceLogout signs a user out of every session, revokes their API tokens
+// and closes their sockets.
+func ForceLogout(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromToken(r)
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if userID == adminID {
+		http.Error(w, "Cannot force logout of your own account", http.StatusBadRequest)
+		return
+	}
+
+	if !checkOutranks(w, r, userID, "Error revoking sessions") {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeUserAPITokens(tx, userID); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	Manager.DisconnectUser(userID)
+
+	recordAudit(r, auditAdminLogout, adminID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkOutranks reports whether the caller's role ranks above the role of
+// userID, writing an error response when it does not or the user is unknown.
+func checkOutranks(w http.ResponseWriter, r *http.Request, userID int, message string) bool {
+	var targetRole string
+	err := database.DB.QueryRow(`SELECT role FROM users WHERE id = $1`, userID).Scan(&targetRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, message, http.StatusInternalServerError)
+		return false
+	}
+
+	role, _ := r.Context().Value("role").(string)
+	if roleRanks[targetRole] >= roleRanks[role] {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func SetUserRole(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromToken(r)
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := roleRanks[req.Role]; !ok {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	if userID == adminID {
+		http.Error(w, "Cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	// Admins cannot demote each other; the set-role subcommand can
+	if !checkOutranks(w, r, userID, "Error updating role") {
+		return
+	}
+
+	if err := setRole(userID, req.Role); err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating role", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditAdminSetRole, adminID, auditTargetUser, userID, map[string]interface{}{
+		"role": req.Role,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setRole changes a user's role and revokes their sessions, since access
+// tokens carry the role they were issued with.
+func setRole(userID int, role string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET role = $1
+		WHERE id = $2
+	`, role, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRoleByEmail is used by the set-role subcommand to bootstrap the
+// first admin.
+func SetRoleByEmail(email, role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return errUnknownRole
+	}
+
+	var userID int
+	err := database.DB.QueryRow(`
+		SELECT id FROM users WHERE LOWER(email) = LOWER($1)
+	`, strings.TrimSpace(email)).Scan(&userID)
+	if err != nil {
+		return err
+	}
+
+	if err := setRole(userID, role); err != nil {
+		return err
+	}
+
+	recordAudit(nil, auditAdminSetRole, 0, auditTargetUser, userID, map[string]interface{}{
+		"role":   role,
+		"source": "cli",
+	})
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"match-me/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+const adminID = 1
+
+func setUserRole(userID int, role string) *httptest.ResponseRecorder {
+	r := withSession(httptest.NewRequest("PUT", "/", nil), adminID, 1)
+	r = r.WithContext(context.WithValue(r.Context(), "role", models.RoleAdmin))
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(userID)})
+	return post(SetUserRole, r, map[string]string{"role": role})
+}
+
+func expectRole(mock sqlmock.Sqlmock, userID int, role string) {
+	mock.ExpectQuery("SELECT role FROM users").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(role))
+}
+
+func TestSetUserRoleCannotDemoteAdmin(t *testing.T) {
+	mock := newMockDB(t)
+	expectRole(mock, 2, models.RoleAdmin)
+
+	if w := setUserRole(2, models.RoleUser); w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	mock := newMockDB(t)
+	expectRole(mock, 2, models.RoleModerator)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users\\s+SET role = \\$1").
+		WithArgs(models.RoleAdmin, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions").
+		WithArgs(2, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectAudit(mock, auditAdminSetRole)
+
+	if w := setUserRole(2, models.RoleAdmin); w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSetUserRoleUnknownUser(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("SELECT role FROM users").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}))
+
+	if w := setUserRole(2, models.RoleModerator); w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+)
+
+// Audited actions.
+const (
+	auditLoginSuccess       = "login.success"
+	auditLoginFailure       = "login.failure"
+	auditPasswordChange     = "password.change"
+	auditPasswordReset      = "password.reset"
+	auditEmailChangeRequest = "email.change_request"
+	auditEmailChange        = "email.change"
+	auditTokenCreate        = "token.create"
+	auditTokenRevoke        = "token.revoke"
+	auditBlock              = "block.create"
+	auditUnblock            = "block.delete"
+	auditReportCreate       = "report.create"
+	auditReportUpdate       = "report.update"
+	auditReportNote         = "report.note"
+	auditAdminSetState      = "admin.set_state"
+	auditAdminLogout        = "admin.logout"
+	auditAdminSetRole       = "admin.set_role"
+	auditAdminUnlock        = "admin.unlock"
+	auditTOTPEnroll         = "totp.enroll"
+	auditTOTPEnable         = "totp.enable"
+	auditTOTPDisable        = "totp.disable"
+	auditRecoveryCodeUse    = "totp.recovery_code"
+	auditSessionRevoke      = "session.revoke"
+	auditSessionRevokeOther = "session.revoke_others"
+	auditRefreshReuse       = "session.refresh_reuse"
+	auditIdentityLink       = "identity.link"
+	auditIdentityUnlink     = "identity.unlink"
+	auditAccountDelete      = "account.delete"
+	auditAccountDeactivate  = "account.deactivate"
+)
+
+// Audit target types.
+const (
+	auditTargetUser    = "user"
+	auditTargetToken   = "api_token"
+	auditTargetReport  = "report"
+	auditTargetSession = "session"
+)
+
+// auditRetention is how long audit entries are kept, configured by
+// AUDIT_LOG_RETENTION (for example "8760h"). Zero keeps them forever.
+var auditRetention = loadAuditRetention()
+
+func loadAuditRetention() time.Duration {
+	value := os.Getenv("AUDIT_LOG_RETENTION")
+	if value == "" {
+		return 365 * 24 * time.Hour
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		log.Fatalf("Invalid AUDIT_LOG_RETENTION %q", value)
+	}
+	return retention
+}
+
+// recordAudit appends an entry to the audit log. actorID and targetID are
+// omitted when zero, and r may be nil for actions without a request.
+// Failures are logged rather than returned so auditing never breaks the
+// action being audited.
+func recordAudit(r *http.Request, action string, actorID int, targetType string, targetID int, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	data, err := json.Marshal(details)
+	if err != nil {
+		log.Printf("error encoding audit details for %s: %v", action, err)
+		return
+	}
+
+	var ip, userAgent string
+	if r != nil {
+		ip = clientIP(r)
+		userAgent = r.UserAgent()
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO audit_log (action, actor_id, target_type, target_id, ip, user_agent, details)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), NULLIF($4, 0), $5, $6, $7)
+	`, action, actorID, targetType, targetID, ip, userAgent, string(data))
+	if err != nil {
+		log.Printf("error writing audit entry for %s: %v", action, err)
+	}
+}
+
+// GetAuditLog lists audit entries, newest first, filtered by action,
+// actor, target and time range.
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > maxAdminPageSize {
+		limit = defaultAdminPageSize
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var ids [2]int
+	for i, name := range []string{"actor_id", "target_id"} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			ids[i] = id
+		}
+	}
+
+	var times [2]*time.Time
+	for i, name := range []string{"since", "until"} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			times[i] = &t
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, action, actor_id, target_type, target_id, ip, user_agent, details, created_at
+		FROM audit_log
+		WHERE ($1 = '' OR action = $1)
+		AND ($2 = 0 OR actor_id = $2)
+		AND ($3 = '' OR target_type = $3)
+		AND ($4 = 0 OR target_id = $4)
+		AND ($5::timestamptz IS NULL OR created_at >= $5)
+		AND ($6::timestamptz IS NULL OR created_at < $6)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $7 OFFSET $8
+	`, query.Get("action"), ids[0], query.Get("target_type"), ids[1], times[0], times[1], limit, offset)
+	if err != nil {
+		http.Error(w, "Error fetching audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var details []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Action,
+			&entry.ActorID,
+			&entry.TargetType,
+			&entry.TargetID,
+			&entry.IP,
+			&entry.UserAgent,
+			&details,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			http.Error(w, "Error scanning audit log", http.StatusInternalServerError)
+			return
+		}
+		entry.Details = details
+		entries = append(entries, entry)
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+func purgeExpiredAuditEntries() {
+	if auditRetention == 0 {
+		return
+	}
+
+	_, err := database.DB.Exec(`
+		DELETE FROM audit_log
+		WHERE created_at < $1
+	`, time.Now().Add(-auditRetention))
+	if err != nil {
+		log.Printf("error purging audit log: %v", err)
+	}
+}
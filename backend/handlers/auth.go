@@ -2,21 +2,37 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"os"
-	"time"
+	"strings"
 
 	"match-me/database"
 	"match-me/models"
+	"match-me/signing"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
+// Keys signs and verifies every token the API issues. main loads it
+// with signing.FromEnv() and refuses to start without a key.
+var Keys *signing.KeySet
+
+// Access tokens and purpose tokens are signed with the same key, so each
+// kind has its own typ header, and each purpose its own audience.
+const (
+	accessTokenType       = "at+jwt"
+	accessTokenAudience   = "match-me"
+	purposeTokenType      = "purpose+jwt"
+	purposeAudiencePrefix = "match-me:"
+)
 
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID    int    `json:"user_id"`
+	SessionID int    `json:"sid"`
+	Role      string `json:"role"`
 	jwt.RegisteredClaims
 }
 
@@ -25,16 +41,21 @@ func GetMe(w http.ResponseWriter, r *http.Request) {
 
 	var user models.User
 	err := database.DB.QueryRow(`
-		SELECT id, email
+		SELECT id, email, email_verified, role, state
 		FROM users
 		WHERE id = $1
-	`, userID).Scan(&user.ID, &user.Email)
+	`, userID).Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Role, &user.State)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
+	// Shadow bans are never revealed to the banned user
+	if user.State == models.StateShadowBanned {
+		user.State = models.StateActive
+	}
+
 	json.NewEncoder(w).Encode(user)
 }
 
@@ -45,6 +66,16 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
+	if !checkPasswordPolicy(w, req.Password) {
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
@@ -56,8 +87,12 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		INSERT INTO users (email, password)
 		VALUES ($1, $2)
 		RETURNING id
-	`, req.Email, string(hashedPassword)).Scan(&userID)
+	`, email, string(hashedPassword)).Scan(&userID)
 
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
@@ -82,6 +117,10 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := sendVerificationEmail(userID, email); err != nil {
+		log.Printf("error sending verification email: %v", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -92,39 +131,78 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keys := loginThrottleKeys(r, req.Email)
+	if wait := checkLoginThrottle(keys); wait > 0 {
+		recordAudit(r, auditLoginFailure, 0, "", 0, map[string]interface{}{
+			"email":  strings.TrimSpace(req.Email),
+			"reason": "throttled",
+		})
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
 	var user models.User
 	err := database.DB.QueryRow(`
-		SELECT id, email, password
+		SELECT id, email, COALESCE(password, '')
 		FROM users
-		WHERE email = $1
-	`, req.Email).Scan(&user.ID, &user.Email, &user.Password)
+		WHERE LOWER(email) = LOWER($1)
+	`, strings.TrimSpace(req.Email)).Scan(&user.ID, &user.Email, &user.Password)
 
 	if err != nil {
+		compareDummyPassword(req.Password)
+		recordLoginFailure(keys)
+		recordAudit(r, auditLoginFailure, 0, "", 0, map[string]interface{}{
+			"email":  strings.TrimSpace(req.Email),
+			"reason": "unknown_email",
+		})
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// Accounts created through social login have no password. Comparing
+	// against the dummy hash keeps them from answering faster.
+	if user.Password == "" {
+		compareDummyPassword(req.Password)
+		recordLoginFailure(keys)
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, user.ID, map[string]interface{}{
+			"reason": "no_password",
+		})
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		recordLoginFailure(keys)
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, user.ID, map[string]interface{}{
+			"reason": "wrong_password",
+		})
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	// Check before the second factor so suspended users are not asked for it
+	var suspended *suspensionError
+	if err := checkSuspension(user.ID); errors.As(err, &suspended) {
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, user.ID, map[string]interface{}{
+			"reason": "suspended",
+		})
+		http.Error(w, suspended.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Error checking account", http.StatusInternalServerError)
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		http.Error(w, "Error creating token", http.StatusInternalServerError)
+	// Failures are only forgotten once the second factor is passed too,
+	// so a known password cannot reset the count for guessing codes
+	if isTOTPEnabled(user.ID) {
+		writeMFAChallenge(w, user.ID)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
-}
\ No newline at end of file
+	if err := clearLoginFailures(keys[0].key); err != nil {
+		log.Printf("error clearing login failures: %v", err)
+	}
+
+	writeNewSession(w, r, user.ID, "password")
+}
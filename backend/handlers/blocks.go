@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/gorilla/mux"
+)
+
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	blockedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if blockedID == userID {
+		http.Error(w, "Cannot block yourself", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = database.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, blockedID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO blocks (blocker_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+	`, userID, blockedID)
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+
+	// Blocking ends any connection or pending request between the two users
+	_, err = tx.Exec(`
+		UPDATE connections
+		SET status = $3, responded_at = NOW()
+		WHERE ((user_id_1 = $1 AND user_id_2 = $2) OR (user_id_1 = $2 AND user_id_2 = $1))
+		AND status IN ($4, $5)
+	`, userID, blockedID, models.ConnectionUnmatched, models.ConnectionPending, models.ConnectionAccepted)
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditBlock, userID, auditTargetUser, blockedID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	blockedID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	_, err = database.DB.Exec(`
+		DELETE FROM blocks
+		WHERE blocker_id = $1 AND blocked_id = $2
+	`, userID, blockedID)
+	if err != nil {
+		http.Error(w, "Error unblocking user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditUnblock, userID, auditTargetUser, blockedID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	rows, err := database.DB.Query(`
+		SELECT b.blocked_id, p.name, p.profile_picture, b.created_at
+		FROM blocks b
+		LEFT JOIN profiles p ON p.user_id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error fetching blocked users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocks := []models.Block{}
+	for rows.Next() {
+		var block models.Block
+		var name, picture sql.NullString
+		if err := rows.Scan(&block.UserID, &name, &picture, &block.CreatedAt); err != nil {
+			http.Error(w, "Error scanning blocked users", http.StatusInternalServerError)
+			return
+		}
+		block.Name = name.String
+		block.ProfilePicture = picture.String
+		blocks = append(blocks, block)
+	}
+
+	json.NewEncoder(w).Encode(blocks)
+}
+
+func Unmatch(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	connectionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE connections
+		SET status = $1, responded_at = NOW()
+		WHERE id = $2 AND (user_id_1 = $3 OR user_id_2 = $3)
+		AND status = $4
+	`, models.ConnectionUnmatched, connectionID, userID, models.ConnectionAccepted)
+	if err != nil {
+		http.Error(w, "Error unmatching connection", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isBlocked reports whether either user has blocked the other.
+func isBlocked(userID1, userID2 int) bool {
+	var blocked bool
+	err := database.DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2)
+			OR (blocker_id = $2 AND blocked_id = $1)
+		)
+	`, userID1, userID2).Scan(&blocked)
+
+	// Treat lookup failures as blocked so errors never leak messages
+	return err != nil || blocked
+}
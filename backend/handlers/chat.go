@@ -3,6 +3,7 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"match-me/database"
@@ -56,11 +57,12 @@ func (manager *ClientManager) Run() {
 			manager.mutex.Lock()
 			// Get the users involved in this connection
 			var userID1, userID2 int
+			var status string
 			err := database.DB.QueryRow(`
-				SELECT user_id_1, user_id_2
+				SELECT user_id_1, user_id_2, status
 				FROM connections
 				WHERE id = $1
-			`, message.ConnectionID).Scan(&userID1, &userID2)
+			`, message.ConnectionID).Scan(&userID1, &userID2, &status)
 
 			if err != nil {
 				log.Printf("error getting connection users: %v", err)
@@ -68,8 +70,19 @@ func (manager *ClientManager) Run() {
 				continue
 			}
 
-			// Only send the message to users who are part of this connection
+			// Drop messages on connections that were unmatched or blocked
+			// while the sender still had the socket open
+			if status != models.ConnectionAccepted || isBlocked(userID1, userID2) {
+				manager.mutex.Unlock()
+				continue
+			}
+
+			// Only send the message to users who are part of this
+			// connection. Hidden messages only go back to their sender.
 			for conn, userID := range manager.clients {
+				if message.Hidden && userID != message.SenderID {
+					continue
+				}
 				if userID == userID1 || userID == userID2 {
 					if err := conn.WriteJSON(message); err != nil {
 						conn.Close()
@@ -82,9 +95,32 @@ func (manager *ClientManager) Run() {
 	}
 }
 
+// DisconnectUser closes every open WebSocket of userID.
+func (manager *ClientManager) DisconnectUser(userID int) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for conn, id := range manager.clients {
+		if id == userID {
+			conn.Close()
+			delete(manager.clients, conn)
+		}
+	}
+}
+
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	userID, _ := getUserIDFromToken(r)
-	connectionID := mux.Vars(r)["connectionId"]
+	connectionID, err := strconv.Atoi(mux.Vars(r)["connectionId"])
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+
+	// Only accepted connections can be chatted on
+	if !isConnectionMember(connectionID, userID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -113,24 +149,34 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
+			// Stop accepting messages once the connection is unmatched or blocked
+			if !isConnectionMember(connectionID, userID) {
+				break
+			}
+
+			// Messages from shadow-banned users are saved but hidden from
+			// the other side, and do not show up as the last message
+			hidden := isShadowBanned(userID)
+
 			var message models.Message
 			err = database.DB.QueryRow(`
 				WITH new_message AS (
-					INSERT INTO messages (connection_id, sender_id, content)
-					VALUES ($1, $2, $3)
-					RETURNING id, connection_id, sender_id, content, read, created_at
+					INSERT INTO messages (connection_id, sender_id, content, hidden)
+					VALUES ($1, $2, $3, $4)
+					RETURNING id, connection_id, sender_id, content, read, hidden, created_at
 				)
 				UPDATE connections
-				SET last_message = $3,
-					last_message_at = NOW()
+				SET last_message = CASE WHEN $4 THEN last_message ELSE $3 END,
+					last_message_at = CASE WHEN $4 THEN last_message_at ELSE NOW() END
 				WHERE id = $1
 				RETURNING (SELECT * FROM new_message)
-			`, connectionID, userID, msg.Content).Scan(
+			`, connectionID, userID, msg.Content, hidden).Scan(
 				&message.ID,
 				&message.ConnectionID,
 				&message.SenderID,
 				&message.Content,
 				&message.Read,
+				&message.Hidden,
 				&message.CreatedAt,
 			)
 
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"match-me/database"
 	"match-me/models"
@@ -32,9 +34,11 @@ func GetConnections(w http.ResponseWriter, r *http.Request) {
 					WHERE m.connection_id = c.id
 					AND m.sender_id != $1
 					AND NOT m.read
+					AND NOT m.hidden
 				) as unread_count
 			FROM connections c
-			WHERE c.user_id_1 = $1 OR c.user_id_2 = $1
+			WHERE (c.user_id_1 = $1 OR c.user_id_2 = $1)
+			AND c.status = $2
 		)
 		SELECT 
 			ci.*,
@@ -43,7 +47,7 @@ func GetConnections(w http.ResponseWriter, r *http.Request) {
 		FROM connection_info ci
 		LEFT JOIN profiles p ON p.user_id = ci.other_user_id
 		ORDER BY ci.last_message_at DESC NULLS LAST
-	`, userID)
+	`, userID, models.ConnectionAccepted)
 
 	if err != nil {
 		http.Error(w, "Error fetching connections", http.StatusInternalServerError)
@@ -115,32 +119,267 @@ func CreateConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var connectionID int
-	err := database.DB.QueryRow(`
-		INSERT INTO connections (user_id_1, user_id_2)
-		VALUES ($1, $2)
-		ON CONFLICT (user_id_1, user_id_2) DO NOTHING
-		RETURNING id
-	`, userID, req.UserID).Scan(&connectionID)
+	if !isEmailVerified(userID) {
+		http.Error(w, "Please verify your email address first", http.StatusForbidden)
+		return
+	}
+
+	// Hidden accounts cannot be connected with either
+	if !isDiscoverable(req.UserID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if isBlocked(userID, req.UserID) {
+		http.Error(w, "Cannot connect with this user", http.StatusForbidden)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The unique constraint only covers one direction, so requests both
+	// ways at once would otherwise create two rows
+	if err := lockPair(tx, userID, req.UserID); err != nil {
+		http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+		return
+	}
+
+	// Look for an existing connection between the two users in either direction
+	var conn models.Connection
+	err = tx.QueryRow(`
+		SELECT id, user_id_1, user_id_2, status
+		FROM connections
+		WHERE (user_id_1 = $1 AND user_id_2 = $2)
+		OR (user_id_1 = $2 AND user_id_2 = $1)
+	`, userID, req.UserID).Scan(&conn.ID, &conn.UserID1, &conn.UserID2, &conn.Status)
+
+	switch {
+	case err == sql.ErrNoRows:
+		conn.Status = models.ConnectionPending
+		err = tx.QueryRow(`
+			INSERT INTO connections (user_id_1, user_id_2, status)
+			VALUES ($1, $2, $3)
+			RETURNING id
+		`, userID, req.UserID, conn.Status).Scan(&conn.ID)
+
+	case err != nil:
+		// Fall through to the error handling below
+
+	case conn.Status == models.ConnectionAccepted:
+		// Already connected, nothing to do
+
+	case conn.Status == models.ConnectionPending && conn.UserID1 == userID:
+		// Request already sent, nothing to do
+
+	case conn.Status == models.ConnectionPending && !canFormConnection(userID):
+		// Looks like a request sent back, but the pair is never connected
+		conn.Status = models.ConnectionPending
+
+	case conn.Status == models.ConnectionPending:
+		// The other user already asked us, so asking back accepts their request
+		conn.Status = models.ConnectionAccepted
+		_, err = tx.Exec(`
+			UPDATE connections
+			SET status = $1, responded_at = NOW()
+			WHERE id = $2
+		`, conn.Status, conn.ID)
+
+	case conn.Status == models.ConnectionDeclined && conn.UserID1 == userID:
+		http.Error(w, "Connection request was declined", http.StatusConflict)
+		return
+
+	default:
+		// Declined or withdrawn requests can be reopened as a new request from us
+		conn.Status = models.ConnectionPending
+		_, err = tx.Exec(`
+			UPDATE connections
+			SET user_id_1 = $1, user_id_2 = $2, status = $3, responded_at = NULL, created_at = NOW()
+			WHERE id = $4
+		`, userID, req.UserID, conn.Status, conn.ID)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connection_id": conn.ID,
+		"status":        conn.Status,
+	})
+}
+
+// canFormConnection reports whether userID's requests, accepts and likes
+// may connect them to anyone. Shadow-banned users get the usual responses,
+// but their requests stay hidden and are never accepted; accepting one
+// is refused by respondToConnection.
+func canFormConnection(userID int) bool {
+	return !isShadowBanned(userID)
+}
+
+// lockPair serialises changes to the connection between two users until
+// tx ends.
+func lockPair(tx *sql.Tx, userID1, userID2 int) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(LEAST($1::int, $2::int), GREATEST($1::int, $2::int))`, userID1, userID2)
+	return err
+}
+
+func GetIncomingRequests(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	listConnectionRequests(w, `
+		SELECT c.id, c.user_id_1, c.created_at, p.name, p.profile_picture
+		FROM connections c
+		JOIN users u ON u.id = c.user_id_1
+		LEFT JOIN profiles p ON p.user_id = c.user_id_1
+		WHERE c.user_id_2 = $1 AND c.status = $2
+		AND u.state != $3
+		ORDER BY c.created_at DESC
+	`, userID, models.ConnectionPending, models.StateShadowBanned)
+}
+
+func GetOutgoingRequests(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	listConnectionRequests(w, `
+		SELECT c.id, c.user_id_2, c.created_at, p.name, p.profile_picture
+		FROM connections c
+		LEFT JOIN profiles p ON p.user_id = c.user_id_2
+		WHERE c.user_id_1 = $1 AND c.status = $2
+		ORDER BY c.created_at DESC
+	`, userID, models.ConnectionPending)
+}
+
+// listConnectionRequests writes the pending requests selected by query,
+// which must return the request id, the other user's id, the request
+// time and the other user's name and picture.
+func listConnectionRequests(w http.ResponseWriter, query string, args ...interface{}) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Error fetching connection requests", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []map[string]interface{}{}
+	for rows.Next() {
+		var req struct {
+			ID             int
+			OtherUserID    int
+			CreatedAt      time.Time
+			Name           sql.NullString
+			ProfilePicture sql.NullString
+		}
+
+		err := rows.Scan(&req.ID, &req.OtherUserID, &req.CreatedAt, &req.Name, &req.ProfilePicture)
+		if err != nil {
+			http.Error(w, "Error scanning connection requests", http.StatusInternalServerError)
+			return
+		}
+
+		requests = append(requests, map[string]interface{}{
+			"id":              req.ID,
+			"other_user_id":   req.OtherUserID,
+			"name":            req.Name.String,
+			"profile_picture": req.ProfilePicture.String,
+			"created_at":      req.CreatedAt,
+		})
+	}
 
+	json.NewEncoder(w).Encode(requests)
+}
+
+func AcceptConnection(w http.ResponseWriter, r *http.Request) {
+	respondToConnection(w, r, models.ConnectionAccepted)
+}
+
+func DeclineConnection(w http.ResponseWriter, r *http.Request) {
+	respondToConnection(w, r, models.ConnectionDeclined)
+}
+
+func WithdrawConnection(w http.ResponseWriter, r *http.Request) {
+	respondToConnection(w, r, models.ConnectionWithdrawn)
+}
+
+// respondToConnection moves a pending request to status. Only the
+// recipient may accept or decline, and only the sender may withdraw.
+func respondToConnection(w http.ResponseWriter, r *http.Request, status string) {
+	userID, _ := getUserIDFromToken(r)
+	connectionID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		// If no rows were affected, check if connection exists in reverse order
-		err = database.DB.QueryRow(`
-			SELECT id FROM connections
-			WHERE (user_id_1 = $2 AND user_id_2 = $1)
-		`, userID, req.UserID).Scan(&connectionID)
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
 
+	actor := "user_id_2"
+	if status == models.ConnectionWithdrawn {
+		actor = "user_id_1"
+	}
+
+	// Accepting as a shadow-banned user answers as usual but leaves the
+	// request pending
+	newStatus := status
+	if status == models.ConnectionAccepted && !canFormConnection(userID) {
+		newStatus = models.ConnectionPending
+	}
+
+	// Requests from users who have since been hidden cannot be accepted,
+	// like any request to them, even by guessing the request's ID
+	if status == models.ConnectionAccepted {
+		var senderID int
+		err := database.DB.QueryRow(`
+			SELECT user_id_1 FROM connections
+			WHERE id = $1 AND user_id_2 = $2 AND status = $3
+		`, connectionID, userID, models.ConnectionPending).Scan(&senderID)
+		if err == sql.ErrNoRows || (err == nil && !isDiscoverable(senderID)) {
+			http.Error(w, "Connection request not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+			http.Error(w, "Error updating connection request", http.StatusInternalServerError)
 			return
 		}
 	}
 
-	json.NewEncoder(w).Encode(map[string]int{
+	result, err := database.DB.Exec(`
+		UPDATE connections
+		SET status = $1, responded_at = NOW()
+		WHERE id = $2 AND `+actor+` = $3 AND status = $4
+	`, newStatus, connectionID, userID, models.ConnectionPending)
+	if err != nil {
+		http.Error(w, "Error updating connection request", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Connection request not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"connection_id": connectionID,
+		"status":        status,
 	})
 }
 
+// isConnectionMember reports whether userID is part of an accepted connection.
+func isConnectionMember(connectionID, userID int) bool {
+	var count int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM connections
+		WHERE id = $1 AND (user_id_1 = $2 OR user_id_2 = $2)
+		AND status = $3
+	`, connectionID, userID, models.ConnectionAccepted).Scan(&count)
+
+	return err == nil && count > 0
+}
+
 func GetMessages(w http.ResponseWriter, r *http.Request) {
 	userID, _ := getUserIDFromToken(r)
 	params := mux.Vars(r)
@@ -151,13 +390,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify user is part of the connection
-	var count int
-	err = database.DB.QueryRow(`
-		SELECT COUNT(*) FROM connections 
-		WHERE id = $1 AND (user_id_1 = $2 OR user_id_2 = $2)
-	`, connectionID, userID).Scan(&count)
-
-	if err != nil || count == 0 {
+	if !isConnectionMember(connectionID, userID) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -169,6 +402,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 		WHERE connection_id = $1
 		AND sender_id != $2
 		AND NOT read
+		AND NOT hidden
 	`, connectionID, userID)
 
 	if err != nil {
@@ -176,13 +410,14 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch messages
+	// Fetch messages. Hidden messages are only shown to their sender.
 	rows, err := database.DB.Query(`
 		SELECT id, connection_id, sender_id, content, read, created_at
 		FROM messages
 		WHERE connection_id = $1
+		AND (NOT hidden OR sender_id = $2)
 		ORDER BY created_at ASC
-	`, connectionID)
+	`, connectionID, userID)
 
 	if err != nil {
 		http.Error(w, "Error fetching messages", http.StatusInternalServerError)
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"match-me/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func expectState(mock sqlmock.Sqlmock, userID int, state string) {
+	mock.ExpectQuery("SELECT state FROM users").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow(state))
+}
+
+func expectDiscoverable(mock sqlmock.Sqlmock, userID int, discoverable bool) {
+	mock.ExpectQuery("SELECT email_verified AND deletion_scheduled_at IS NULL").
+		WithArgs(userID, models.StateActive, models.StateSuspended).
+		WillReturnRows(sqlmock.NewRows([]string{"discoverable"}).AddRow(discoverable))
+}
+
+func acceptConnection(userID, connectionID int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(connectionID)})
+	w := httptest.NewRecorder()
+	AcceptConnection(w, withSession(r, userID, 1))
+	return w
+}
+
+func TestAcceptConnectionFromHiddenSender(t *testing.T) {
+	mock := newMockDB(t)
+	expectState(mock, 5, models.StateActive)
+	mock.ExpectQuery("SELECT user_id_1 FROM connections").
+		WithArgs(3, 5, models.ConnectionPending).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id_1"}).AddRow(9))
+	// A shadow-banned sender is not discoverable
+	expectDiscoverable(mock, 9, false)
+
+	if w := acceptConnection(5, 3); w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAcceptConnection(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  string
+		status string
+	}{
+		{"accepted", models.StateActive, models.ConnectionAccepted},
+		{"shadow-banned recipient leaves it pending", models.StateShadowBanned, models.ConnectionPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectState(mock, 5, tt.state)
+			mock.ExpectQuery("SELECT user_id_1 FROM connections").
+				WithArgs(3, 5, models.ConnectionPending).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id_1"}).AddRow(9))
+			expectDiscoverable(mock, 9, true)
+			mock.ExpectExec("UPDATE connections").
+				WithArgs(tt.status, 3, 5, models.ConnectionPending).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			if w := acceptConnection(5, 3); w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+)
+
+// passCooldown is how long a passed user stays out of recommendations,
+// configured by PASS_COOLDOWN (for example "720h").
+var passCooldown = loadPassCooldown()
+
+func loadPassCooldown() time.Duration {
+	value := os.Getenv("PASS_COOLDOWN")
+	if value == "" {
+		return 30 * 24 * time.Hour
+	}
+
+	cooldown, err := time.ParseDuration(value)
+	if err != nil || cooldown < 0 {
+		log.Fatalf("Invalid PASS_COOLDOWN %q", value)
+	}
+	return cooldown
+}
+
+// Decide records whether the caller likes, passes on or super-likes a
+// user. Deciding again replaces the earlier decision. When two users like
+// each other they are connected straight away.
+func Decide(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		UserID int    `json:"user_id"`
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case models.DecisionLike, models.DecisionPass, models.DecisionSuperLike:
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID == userID {
+		http.Error(w, "Cannot decide on yourself", http.StatusBadRequest)
+		return
+	}
+
+	if !isEmailVerified(userID) {
+		http.Error(w, "Please verify your email address first", http.StatusForbidden)
+		return
+	}
+
+	if !isDiscoverable(req.UserID) || isBlocked(userID, req.UserID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error saving decision", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialise decisions within a pair so two simultaneous likes still
+	// see each other
+	if err := lockPair(tx, userID, req.UserID); err != nil {
+		http.Error(w, "Error saving decision", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO decisions (user_id, target_id, action)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, target_id)
+		DO UPDATE SET action = EXCLUDED.action, created_at = NOW()
+	`, userID, req.UserID, req.Action)
+	if err != nil {
+		http.Error(w, "Error saving decision", http.StatusInternalServerError)
+		return
+	}
+
+	var connectionID int
+	if req.Action != models.DecisionPass {
+		connectionID, err = matchIfMutual(tx, userID, req.UserID)
+		if err != nil {
+			http.Error(w, "Error saving decision", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving decision", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"action":  req.Action,
+		"matched": connectionID != 0,
+	}
+	if connectionID != 0 {
+		response["connection_id"] = connectionID
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// matchIfMutual connects userID and targetID if targetID has liked
+// userID back, and returns the connection's ID or 0 if they did not
+// match. Pending, declined and withdrawn requests between the two are
+// accepted, but an unmatched pair stays unmatched.
+func matchIfMutual(tx *sql.Tx, userID, targetID int) (int, error) {
+	if !canFormConnection(userID) {
+		return 0, nil
+	}
+
+	var likedBack bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM decisions
+			WHERE user_id = $1 AND target_id = $2 AND action IN ($3, $4)
+		)
+	`, targetID, userID, models.DecisionLike, models.DecisionSuperLike).Scan(&likedBack)
+	if err != nil || !likedBack {
+		return 0, err
+	}
+
+	var conn models.Connection
+	err = tx.QueryRow(`
+		SELECT id, status
+		FROM connections
+		WHERE (user_id_1 = $1 AND user_id_2 = $2)
+		OR (user_id_1 = $2 AND user_id_2 = $1)
+		FOR UPDATE
+	`, userID, targetID).Scan(&conn.ID, &conn.Status)
+
+	switch {
+	case err == sql.ErrNoRows:
+		// The first to like counts as the one who asked
+		err = tx.QueryRow(`
+			INSERT INTO connections (user_id_1, user_id_2, status, responded_at)
+			VALUES ($1, $2, $3, NOW())
+			RETURNING id
+		`, targetID, userID, models.ConnectionAccepted).Scan(&conn.ID)
+		return conn.ID, err
+
+	case err != nil:
+		return 0, err
+
+	case conn.Status == models.ConnectionAccepted:
+		return conn.ID, nil
+
+	case conn.Status == models.ConnectionUnmatched:
+		return 0, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE connections
+		SET status = $1, responded_at = NOW()
+		WHERE id = $2
+	`, models.ConnectionAccepted, conn.ID)
+	return conn.ID, err
+}
+
+// UndoDecision takes back the caller's most recent decision, so that
+// user can be recommended again. A like that already led to a match
+// cannot be undone; the user has to unmatch instead.
+func UndoDecision(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error undoing decision", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var id int
+	var decision models.Decision
+	err = tx.QueryRow(`
+		SELECT id, target_id, action, created_at
+		FROM decisions
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+		FOR UPDATE
+	`, userID).Scan(&id, &decision.TargetID, &decision.Action, &decision.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Nothing to undo", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error undoing decision", http.StatusInternalServerError)
+		return
+	}
+
+	if decision.Action != models.DecisionPass && areConnected(tx, userID, decision.TargetID) {
+		http.Error(w, "Already matched with this user, unmatch instead", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM decisions WHERE id = $1`, id); err != nil {
+		http.Error(w, "Error undoing decision", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error undoing decision", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(decision)
+}
+
+// areConnected reports whether two users have an accepted connection.
+func areConnected(tx *sql.Tx, userID1, userID2 int) bool {
+	var connected bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM connections
+			WHERE ((user_id_1 = $1 AND user_id_2 = $2) OR (user_id_1 = $2 AND user_id_2 = $1))
+			AND status = $3
+		)
+	`, userID1, userID2, models.ConnectionAccepted).Scan(&connected)
+	return err == nil && connected
+}
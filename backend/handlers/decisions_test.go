@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"match-me/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	deciderID = 5
+	targetID  = 9
+)
+
+// expectDecision expects Decide to save action and reach matchIfMutual.
+func expectDecision(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectQuery("SELECT email_verified FROM users").
+		WithArgs(deciderID).
+		WillReturnRows(sqlmock.NewRows([]string{"email_verified"}).AddRow(true))
+	expectDiscoverable(mock, targetID, true)
+	mock.ExpectQuery("SELECT EXISTS\\(\\s+SELECT 1 FROM blocks").
+		WithArgs(deciderID, targetID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").
+		WithArgs(deciderID, targetID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO decisions").
+		WithArgs(deciderID, targetID, action).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func expectLikedBack(mock sqlmock.Sqlmock, likedBack bool) {
+	mock.ExpectQuery("SELECT EXISTS\\(\\s+SELECT 1 FROM decisions").
+		WithArgs(targetID, deciderID, models.DecisionLike, models.DecisionSuperLike).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(likedBack))
+}
+
+func expectPairConnection(mock sqlmock.Sqlmock, status string) {
+	rows := sqlmock.NewRows([]string{"id", "status"})
+	if status != "" {
+		rows.AddRow(3, status)
+	}
+	mock.ExpectQuery("SELECT id, status\\s+FROM connections").
+		WithArgs(deciderID, targetID).
+		WillReturnRows(rows)
+}
+
+func decide(t *testing.T, action string) map[string]interface{} {
+	t.Helper()
+	r := withSession(httptest.NewRequest("POST", "/", nil), deciderID, 1)
+	w := post(Decide, r, map[string]interface{}{"user_id": targetID, "action": action})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Decide: status %d: %s", w.Code, w.Body)
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestDecideMutualLikeConnects(t *testing.T) {
+	for _, action := range []string{models.DecisionLike, models.DecisionSuperLike} {
+		t.Run(action, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectDecision(mock, action)
+			expectState(mock, deciderID, models.StateActive)
+			expectLikedBack(mock, true)
+			expectPairConnection(mock, "")
+			// The first to like counts as the one who asked
+			mock.ExpectQuery("INSERT INTO connections").
+				WithArgs(targetID, deciderID, models.ConnectionAccepted).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+			mock.ExpectCommit()
+
+			response := decide(t, action)
+			if response["matched"] != true || response["connection_id"] != float64(3) {
+				t.Fatalf("response %v, want a match on connection 3", response)
+			}
+		})
+	}
+}
+
+func TestDecideAcceptsPendingRequest(t *testing.T) {
+	mock := newMockDB(t)
+	expectDecision(mock, models.DecisionLike)
+	expectState(mock, deciderID, models.StateActive)
+	expectLikedBack(mock, true)
+	expectPairConnection(mock, models.ConnectionPending)
+	mock.ExpectExec("UPDATE connections").
+		WithArgs(models.ConnectionAccepted, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if response := decide(t, models.DecisionLike); response["matched"] != true {
+		t.Fatalf("response %v, want a match", response)
+	}
+}
+
+func TestDecideWithoutMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		expect func(sqlmock.Sqlmock)
+	}{
+		{"like not returned", models.DecisionLike, func(mock sqlmock.Sqlmock) {
+			expectState(mock, deciderID, models.StateActive)
+			expectLikedBack(mock, false)
+		}},
+		{"pass is never a match", models.DecisionPass, func(mock sqlmock.Sqlmock) {}},
+		{"unmatched pair stays unmatched", models.DecisionLike, func(mock sqlmock.Sqlmock) {
+			expectState(mock, deciderID, models.StateActive)
+			expectLikedBack(mock, true)
+			expectPairConnection(mock, models.ConnectionUnmatched)
+		}},
+		// The liked-back check is never made, so nothing gives the ban away
+		{"shadow-banned caller", models.DecisionLike, func(mock sqlmock.Sqlmock) {
+			expectState(mock, deciderID, models.StateShadowBanned)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectDecision(mock, tt.action)
+			tt.expect(mock)
+			mock.ExpectCommit()
+
+			response := decide(t, tt.action)
+			if response["matched"] != false || response["connection_id"] != nil {
+				t.Fatalf("response %v, want no match", response)
+			}
+		})
+	}
+}
+
+func expectLastDecision(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, target_id, action, created_at\\s+FROM decisions").
+		WithArgs(deciderID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "target_id", "action", "created_at"}).
+			AddRow(11, targetID, action, time.Now()))
+}
+
+func expectConnected(mock sqlmock.Sqlmock, connected bool) {
+	mock.ExpectQuery("SELECT EXISTS\\(\\s+SELECT 1 FROM connections").
+		WithArgs(deciderID, targetID, models.ConnectionAccepted).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(connected))
+}
+
+func undo() *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	UndoDecision(w, withSession(httptest.NewRequest("DELETE", "/", nil), deciderID, 1))
+	return w
+}
+
+func TestUndoDecisionRefusedAfterMatch(t *testing.T) {
+	mock := newMockDB(t)
+	expectLastDecision(mock, models.DecisionLike)
+	expectConnected(mock, true)
+	mock.ExpectRollback()
+
+	if w := undo(); w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestUndoDecision(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		expect func(sqlmock.Sqlmock)
+	}{
+		{"unreturned like", models.DecisionLike, func(mock sqlmock.Sqlmock) {
+			expectConnected(mock, false)
+		}},
+		{"pass", models.DecisionPass, func(mock sqlmock.Sqlmock) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectLastDecision(mock, tt.action)
+			tt.expect(mock)
+			mock.ExpectExec("DELETE FROM decisions").
+				WithArgs(11).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			w := undo()
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var decision models.Decision
+			if err := json.NewDecoder(w.Body).Decode(&decision); err != nil {
+				t.Fatal(err)
+			}
+			if decision.TargetID != targetID || decision.Action != tt.action {
+				t.Errorf("undid %+v, want %s on %d", decision, tt.action, targetID)
+			}
+		})
+	}
+}
+
+func TestUndoDecisionNothingToUndo(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, target_id, action, created_at\\s+FROM decisions").
+		WithArgs(deciderID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "target_id", "action", "created_at"}))
+	mock.ExpectRollback()
+
+	if w := undo(); w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
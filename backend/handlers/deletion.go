@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"match-me/database"
+)
+
+const purgeInterval = time.Hour
+
+// deletionGracePeriod is how long a deleted account can still be restored
+// by logging in, configured by ACCOUNT_DELETION_GRACE_PERIOD (for example
+// "168h"). Zero erases the account immediately.
+var deletionGracePeriod = loadDeletionGracePeriod()
+
+func loadDeletionGracePeriod() time.Duration {
+	value := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD")
+	if value == "" {
+		return 7 * 24 * time.Hour
+	}
+
+	period, err := time.ParseDuration(value)
+	if err != nil || period < 0 {
+		log.Fatalf("Invalid ACCOUNT_DELETION_GRACE_PERIOD %q", value)
+	}
+	return period
+}
+
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		Password    string `json:"password"`
+		ReauthToken string `json:"reauth_token"`
+		Code        string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := reauthenticate(w, r, userID, req.Password, req.ReauthToken); !ok {
+		return
+	}
+
+	if isTOTPEnabled(userID) && !checkSecondFactor(r, userID, req.Code) {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	purgeAt := time.Now().Add(deletionGracePeriod)
+	_, err = tx.Exec(`
+		UPDATE users
+		SET deletion_scheduled_at = $1
+		WHERE id = $2
+	`, purgeAt, userID)
+	if err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserAPITokens(tx, userID); err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+
+	Manager.DisconnectUser(userID)
+
+	recordAudit(r, auditAccountDelete, userID, auditTargetUser, userID, map[string]interface{}{
+		"purge_at": purgeAt,
+	})
+
+	if deletionGracePeriod == 0 {
+		if err := purgeUser(userID); err != nil {
+			log.Printf("error purging user %d: %v", userID, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purge_at": purgeAt,
+	})
+}
+
+// cancelAccountDeletion restores an account scheduled for deletion. It is
+// called by createSession when the owner logs in during the grace period.
+func cancelAccountDeletion(userID int) error {
+	_, err := database.DB.Exec(`
+		UPDATE users
+		SET deletion_scheduled_at = NULL
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL
+	`, userID)
+	return err
+}
+
+// RunPurger erases accounts whose deletion grace period has passed, and
+// data exports, audit entries, feeds and login failures that have
+// expired. It checks once at startup and then every purgeInterval.
+func RunPurger() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purgeDueAccounts()
+		purgeExpiredExports()
+		purgeExpiredAuditEntries()
+		purgeExpiredFeeds()
+		purgeExpiredLoginFailures()
+		<-ticker.C
+	}
+}
+
+func purgeExpiredExports() {
+	_, err := database.DB.Exec(`DELETE FROM data_exports WHERE expires_at <= NOW()`)
+	if err != nil {
+		log.Printf("error purging expired exports: %v", err)
+	}
+}
+
+func purgeDueAccounts() {
+	rows, err := database.DB.Query(`
+		SELECT id FROM users
+		WHERE deletion_scheduled_at <= NOW()
+	`)
+	if err != nil {
+		log.Printf("error finding accounts to purge: %v", err)
+		return
+	}
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("error scanning accounts to purge: %v", err)
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		if err := purgeUser(userID); err != nil {
+			log.Printf("error purging user %d: %v", userID, err)
+			continue
+		}
+		log.Printf("Purged deleted user %d", userID)
+	}
+}
+
+// purgeUser erases the user row. Foreign keys cascade the delete to the
+// profile, bio, connections, messages and every other row the user owns.
+func purgeUser(userID int) error {
+	var email string
+	err := database.DB.QueryRow(`
+		DELETE FROM users
+		WHERE id = $1
+		RETURNING email
+	`, userID).Scan(&email)
+	if err != nil {
+		return err
+	}
+
+	return clearLoginFailures("account:" + strings.ToLower(email))
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/mailer"
+	"match-me/models"
+)
+
+const emailVerificationTTL = 48 * time.Hour
+
+var errInvalidEmail = errors.New("invalid email address")
+
+// normalizeEmail validates a bare address and returns it trimmed with a
+// lowercase domain. The local part keeps its case; uniqueness is enforced
+// case-insensitively by the database.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", errInvalidEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errInvalidEmail
+	}
+
+	return local + "@" + domain, nil
+}
+
+// sendVerificationEmail emails a link confirming that email belongs to userID.
+func sendVerificationEmail(userID int, email string) error {
+	token, err := signPurposeToken(userID, email, "verify_email", emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return Mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Welcome! Please confirm your email address by following this link:\n%s\n\n"+
+			"The link is valid for 48 hours.", appLink("/verify-email", token)),
+	})
+}
+
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, email, err := parsePurposeToken(req.Token, "verify_email")
+	if err != nil {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE users
+		SET email_verified = true
+		WHERE id = $1 AND email = $2
+	`, userID, email)
+	if err != nil {
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var email string
+	var verified bool
+	err := database.DB.QueryRow(`
+		SELECT email, email_verified
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&email, &verified)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		log.Printf("error sending verification email: %v", err)
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// isDiscoverable reports whether other users may find and connect with
+// userID: the account must be verified, active and not scheduled for
+// deletion. Suspensions that have run out count as active.
+func isDiscoverable(userID int) bool {
+	var discoverable bool
+	err := database.DB.QueryRow(`
+		SELECT email_verified AND deletion_scheduled_at IS NULL
+			AND (state = $2 OR (state = $3 AND suspended_until <= NOW()))
+		FROM users
+		WHERE id = $1
+	`, userID, models.StateActive, models.StateSuspended).Scan(&discoverable)
+
+	return err == nil && discoverable
+}
+
+// isEmailVerified reports whether userID has confirmed their email address.
+func isEmailVerified(userID int) bool {
+	var verified bool
+	err := database.DB.QueryRow(`
+		SELECT email_verified FROM users WHERE id = $1
+	`, userID).Scan(&verified)
+
+	return err == nil && verified
+}
@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	exportTTL = 7 * 24 * time.Hour
+
+	// Pending exports older than this are assumed to have died with the
+	// server that was building them
+	exportBuildTimeout = time.Hour
+)
+
+// RequestDataExport starts building an archive of everything stored about
+// the caller. The archive is built in the background; GetDataExport
+// reports when it is ready to download. While an export is being built or
+// can still be downloaded, it is returned instead of starting another.
+func RequestDataExport(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	export, created, err := findOrCreateDataExport(userID)
+	if err != nil {
+		http.Error(w, "Error requesting export", http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		go buildDataExport(export.ID, userID)
+	}
+
+	if export.Status == models.ExportPending {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(export)
+}
+
+// findOrCreateDataExport returns the user's pending or downloadable
+// export, or creates a pending one and reports that it did.
+func findOrCreateDataExport(userID int) (models.DataExport, bool, error) {
+	var export models.DataExport
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return export, false, err
+	}
+	defer tx.Rollback()
+
+	// Serialise requests from the same user so two at once still share one
+	// export
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, userID); err != nil {
+		return export, false, err
+	}
+
+	err = tx.QueryRow(`
+		SELECT id, status, created_at, completed_at, expires_at
+		FROM data_exports
+		WHERE user_id = $1
+		AND ((status = $2 AND created_at > NOW() - $3 * INTERVAL '1 second')
+			OR (status = $4 AND expires_at > NOW()))
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID, models.ExportPending, exportBuildTimeout.Seconds(), models.ExportReady).Scan(
+		&export.ID, &export.Status, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt,
+	)
+	if err == nil {
+		return export, false, nil
+	} else if err != sql.ErrNoRows {
+		return export, false, err
+	}
+
+	export.Status = models.ExportPending
+	err = tx.QueryRow(`
+		INSERT INTO data_exports (user_id, status)
+		VALUES ($1, $2)
+		RETURNING id, created_at
+	`, userID, export.Status).Scan(&export.ID, &export.CreatedAt)
+	if err != nil {
+		return export, false, err
+	}
+
+	return export, true, tx.Commit()
+}
+
+func GetDataExport(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	exportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusBadRequest)
+		return
+	}
+
+	var export models.DataExport
+	err = database.DB.QueryRow(`
+		SELECT id, status, created_at, completed_at, expires_at
+		FROM data_exports
+		WHERE id = $1 AND user_id = $2
+	`, exportID, userID).Scan(&export.ID, &export.Status, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(export)
+}
+
+func DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	exportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusBadRequest)
+		return
+	}
+
+	var archive []byte
+	err = database.DB.QueryRow(`
+		SELECT archive
+		FROM data_exports
+		WHERE id = $1 AND user_id = $2 AND status = $3 AND expires_at > NOW()
+	`, exportID, userID, models.ExportReady).Scan(&archive)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="match-me-export-%d.zip"`, exportID))
+	w.Write(archive)
+}
+
+func buildDataExport(exportID, userID int) {
+	archive, err := writeDataExport(userID)
+
+	status := models.ExportReady
+	if err != nil {
+		log.Printf("error building export %d: %v", exportID, err)
+		status, archive = models.ExportFailed, nil
+	}
+
+	_, err = database.DB.Exec(`
+		UPDATE data_exports
+		SET status = $1, archive = $2, completed_at = NOW(), expires_at = $3
+		WHERE id = $4
+	`, status, archive, time.Now().Add(exportTTL), exportID)
+	if err != nil {
+		log.Printf("error saving export %d: %v", exportID, err)
+	}
+}
+
+// writeDataExport zips the user's data as JSON files, plus messages as
+// JSON lines since there can be many of them. Everything is encoded from
+// the models types so new fields show up in exports automatically.
+func writeDataExport(userID int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	sections := []struct {
+		name string
+		load func(int) (interface{}, error)
+	}{
+		{"user.json", exportUser},
+		{"profile.json", loadProfile},
+		{"bio.json", loadBio},
+		{"connections.json", exportConnections},
+		{"blocks.json", exportBlocks},
+		{"sessions.json", exportSessions},
+		{"decisions.json", exportDecisions},
+		{"reports.json", exportReports},
+		{"api_tokens.json", exportAPITokens},
+		{"identities.json", exportIdentities},
+	}
+
+	for _, section := range sections {
+		data, err := section.load(userID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", section.name, err)
+		}
+
+		f, err := zw.Create(section.name)
+		if err != nil {
+			return nil, err
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("messages.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	if err := exportMessages(userID, json.NewEncoder(f)); err != nil {
+		return nil, fmt.Errorf("messages.jsonl: %v", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportUser returns every column of the user's account except the
+// password hash and TOTP secret. Like GetMe, it never reveals a shadow
+// ban.
+func exportUser(userID int) (interface{}, error) {
+	var user struct {
+		models.User
+		TOTPEnabled         bool       `json:"totp_enabled"`
+		DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+		CreatedAt           *time.Time `json:"created_at"`
+	}
+	err := database.DB.QueryRow(`
+		SELECT id, email, email_verified, role, state, suspended_until,
+			totp_enabled, deletion_scheduled_at, created_at
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.EmailVerified,
+		&user.Role,
+		&user.State,
+		&user.SuspendedUntil,
+		&user.TOTPEnabled,
+		&user.DeletionScheduledAt,
+		&user.CreatedAt,
+	)
+	if user.State == models.StateShadowBanned {
+		user.State = models.StateActive
+	}
+	return user, err
+}
+
+func loadProfile(userID int) (interface{}, error) {
+	var profile models.Profile
+	var name, bio, picture, location sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT user_id, name, bio, profile_picture, location
+		FROM profiles
+		WHERE user_id = $1
+	`, userID).Scan(&profile.UserID, &name, &bio, &picture, &location)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	profile.Name = name.String
+	profile.Bio = bio.String
+	profile.ProfilePicture = picture.String
+	profile.Location = location.String
+	return profile, err
+}
+
+func loadBio(userID int) (interface{}, error) {
+	var bio models.UserBio
+	err := database.DB.QueryRow(`
+		SELECT user_id, interests, hobbies, music_preferences, food_preferences, looking_for
+		FROM user_bios
+		WHERE user_id = $1
+	`, userID).Scan(
+		&bio.UserID,
+		pq.Array(&bio.Interests),
+		pq.Array(&bio.Hobbies),
+		pq.Array(&bio.MusicPreferences),
+		pq.Array(&bio.FoodPreferences),
+		pq.Array(&bio.LookingFor),
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return bio, err
+}
+
+func exportConnections(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_id_1, user_id_2, status, last_message, last_message_at
+		FROM connections
+		WHERE user_id_1 = $1 OR user_id_2 = $1
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	connections := []models.Connection{}
+	for rows.Next() {
+		var conn models.Connection
+		var lastMessage sql.NullString
+		var lastMessageAt sql.NullTime
+		err := rows.Scan(&conn.ID, &conn.UserID1, &conn.UserID2, &conn.Status, &lastMessage, &lastMessageAt)
+		if err != nil {
+			return nil, err
+		}
+		conn.LastMessage = lastMessage.String
+		conn.LastMessageAt = lastMessageAt.Time
+		connections = append(connections, conn)
+	}
+	return connections, rows.Err()
+}
+
+func exportBlocks(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT blocked_id, created_at
+		FROM blocks
+		WHERE blocker_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []models.Block{}
+	for rows.Next() {
+		var block models.Block
+		if err := rows.Scan(&block.UserID, &block.CreatedAt); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+func exportSessions(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		var userAgent, ip sql.NullString
+		err := rows.Scan(&session.ID, &userAgent, &ip, &session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			return nil, err
+		}
+		session.UserAgent = userAgent.String
+		session.IP = ip.String
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func exportDecisions(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT target_id, action, created_at
+		FROM decisions
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decisions := []models.Decision{}
+	for rows.Next() {
+		var decision models.Decision
+		if err := rows.Scan(&decision.TargetID, &decision.Action, &decision.CreatedAt); err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, rows.Err()
+}
+
+// exportReports returns the reports the user filed. Snapshots, assignees
+// and notes belong to the moderators and are left out.
+func exportReports(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, reporter_id, target_type, reported_user_id, message_id, reason, details,
+			status, created_at, updated_at
+		FROM reports
+		WHERE reporter_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		var report models.Report
+		err := rows.Scan(
+			&report.ID,
+			&report.ReporterID,
+			&report.TargetType,
+			&report.ReportedUserID,
+			&report.MessageID,
+			&report.Reason,
+			&report.Details,
+			&report.Status,
+			&report.CreatedAt,
+			&report.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// exportAPITokens returns every API token the user created, including
+// revoked ones. Only token hashes are stored, so no secrets are exported.
+func exportAPITokens(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, name, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type exportedToken struct {
+		models.APIToken
+		RevokedAt *time.Time `json:"revoked_at"`
+	}
+
+	tokens := []exportedToken{}
+	for rows.Next() {
+		var token exportedToken
+		err := rows.Scan(
+			&token.ID,
+			&token.Name,
+			pq.Array(&token.Scopes),
+			&token.CreatedAt,
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.RevokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func exportIdentities(userID int) (interface{}, error) {
+	rows, err := database.DB.Query(`
+		SELECT provider, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.Identity{}
+	for rows.Next() {
+		var identity models.Identity
+		var email sql.NullString
+		if err := rows.Scan(&identity.Provider, &email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identity.Email = email.String
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// exportMessages streams every message sent or received by the user, one
+// JSON object per line. Messages hidden from the user are left out.
+func exportMessages(userID int, enc *json.Encoder) error {
+	rows, err := database.DB.Query(`
+		SELECT m.id, m.connection_id, m.sender_id, m.content, m.read, m.created_at
+		FROM messages m
+		JOIN connections c ON c.id = m.connection_id
+		WHERE (c.user_id_1 = $1 OR c.user_id_2 = $1)
+		AND (NOT m.hidden OR m.sender_id = $1)
+		ORDER BY m.created_at
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg models.Message
+		err := rows.Scan(&msg.ID, &msg.ConnectionID, &msg.SenderID, &msg.Content, &msg.Read, &msg.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"testing"
+
+	"match-me/database"
+	"match-me/signing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newMockDB points database.DB at a sqlmock database for the rest of the
+// test and checks every expectation was met at the end.
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = old
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return mock
+}
+
+// useTestKeys signs tokens with a fresh key for the rest of the test.
+func useTestKeys(t *testing.T) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := signing.NewKeySet(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := Keys
+	Keys = keys
+	t.Cleanup(func() { Keys = old })
+}
+
+// withSession returns r as AuthMiddleware would pass it on for a session.
+func withSession(r *http.Request, userID, sessionID int) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", userID)
+	ctx = context.WithValue(ctx, "session_id", sessionID)
+	ctx = context.WithValue(ctx, "role", "user")
+	return r.WithContext(ctx)
+}
+
+func expectAudit(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(action, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/totp"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+	totpIssuer        = "MatchMe"
+)
+
+// now is the clock used to check one-time codes. Tests replace it with a
+// fake clock.
+var now = time.Now
+
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var email string
+	var enabled bool
+	err := database.DB.QueryRow(`
+		SELECT email, totp_enabled
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&email, &enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Enrolling again before verifying replaces the previous secret and codes
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = $1, totp_last_step = 0
+		WHERE id = $2
+	`, secret, userID)
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	for _, code := range codes {
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, hashToken(code))
+		if err != nil {
+			http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditTOTPEnroll, userID, auditTargetUser, userID, nil)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":         secret,
+		"otpauth_uri":    totp.URI(secret, totpIssuer, email),
+		"recovery_codes": codes,
+	})
+}
+
+func VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !throttleCodeCheck(w, r, userID, func() bool { return checkTOTP(userID, req.Code) }) {
+		return
+	}
+
+	_, err := database.DB.Exec(`
+		UPDATE users
+		SET totp_enabled = true
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditTOTPEnable, userID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DisableTOTP turns two-factor authentication off. It takes the current
+// password, or a reauth_token for accounts without one, as well as a code.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		Code        string `json:"code"`
+		Password    string `json:"password"`
+		ReauthToken string `json:"reauth_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := reauthenticate(w, r, userID, req.Password, req.ReauthToken); !ok {
+		return
+	}
+
+	if !throttleCodeCheck(w, r, userID, func() bool { return checkSecondFactor(r, userID, req.Code) }) {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditTOTPDisable, userID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mfaThrottleKey counts wrong codes for userID wherever they are checked.
+func mfaThrottleKey(userID int) throttleKey {
+	return throttleKey{key: "mfa:" + strconv.Itoa(userID), threshold: accountFailureThreshold}
+}
+
+// throttleCodeCheck runs check on a code from a signed-in user, so that a
+// stolen session cannot guess codes any faster than LoginMFA allows. It
+// writes the error response and returns false if the user is locked out
+// or the code is wrong.
+func throttleCodeCheck(w http.ResponseWriter, r *http.Request, userID int, check func() bool) bool {
+	keys := []throttleKey{
+		mfaThrottleKey(userID),
+		{key: "ip:" + clientIP(r), threshold: ipFailureThreshold},
+	}
+	if wait := checkLoginThrottle(keys); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return false
+	}
+
+	if !check() {
+		recordLoginFailure(keys)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return false
+	}
+
+	if err := clearLoginFailures(keys[0].key); err != nil {
+		log.Printf("error clearing login failures: %v", err)
+	}
+	return true
+}
+
+// LoginMFA exchanges the challenge token returned by Login together with
+// a TOTP or recovery code for a full session.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := parsePurposeToken(req.MFAToken, "mfa")
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	err = database.DB.QueryRow(`SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short, so guessing them is throttled like passwords, and
+	// also per account under a key that logging in with the password
+	// does not clear
+	keys := append(loginThrottleKeys(r, email), mfaThrottleKey(userID))
+	if wait := checkLoginThrottle(keys); wait > 0 {
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, userID, map[string]interface{}{
+			"reason": "throttled",
+		})
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	if !checkSecondFactor(r, userID, req.Code) {
+		recordLoginFailure(keys)
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, userID, map[string]interface{}{
+			"reason": "wrong_code",
+		})
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	for _, k := range []throttleKey{keys[0], keys[2]} {
+		if err := clearLoginFailures(k.key); err != nil {
+			log.Printf("error clearing login failures: %v", err)
+		}
+	}
+
+	writeNewSession(w, r, userID, "totp")
+}
+
+// writeMFAChallenge answers a correct password for an account with 2FA
+// enabled with a short-lived challenge instead of a session.
+func writeMFAChallenge(w http.ResponseWriter, userID int) {
+	token, err := signPurposeToken(userID, "", "mfa", mfaChallengeTTL)
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    token,
+	})
+}
+
+// checkTOTP validates code against the user's TOTP secret and records
+// its time step so the same code cannot be used twice.
+func checkTOTP(userID int, code string) bool {
+	var secret sql.NullString
+	var lastStep int64
+	err := database.DB.QueryRow(`
+		SELECT totp_secret, totp_last_step
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&secret, &lastStep)
+	if err != nil || !secret.Valid {
+		return false
+	}
+
+	step, ok := totp.Validate(secret.String, code, now())
+	if !ok || step <= lastStep {
+		return false
+	}
+
+	// The step condition makes concurrent use of one code fail for all
+	// but the first request
+	result, err := database.DB.Exec(`
+		UPDATE users
+		SET totp_last_step = $1
+		WHERE id = $2 AND totp_last_step < $1
+	`, step, userID)
+	if err != nil {
+		return false
+	}
+
+	n, err := result.RowsAffected()
+	return err == nil && n > 0
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery
+// code, which is used up.
+func checkSecondFactor(r *http.Request, userID int, code string) bool {
+	if checkTOTP(userID, code) {
+		return true
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false
+	}
+
+	recordAudit(r, auditRecoveryCodeUse, userID, auditTargetUser, userID, nil)
+	return true
+}
+
+// isTOTPEnabled reports whether userID has finished enrolling in 2FA.
+func isTOTPEnabled(userID int) bool {
+	var enabled bool
+	err := database.DB.QueryRow(`
+		SELECT totp_enabled FROM users WHERE id = $1
+	`, userID).Scan(&enabled)
+
+	return err == nil && enabled
+}
+
+// generateRecoveryCodes returns codes formatted as XXXXX-XXXXX.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
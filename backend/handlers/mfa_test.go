@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"match-me/models"
+	"match-me/totp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mfaTestUserID   = 5
+	mfaTestEmail    = "user@example.com"
+	mfaTestPassword = "correct horse battery"
+)
+
+// useClock replaces the clock one-time codes and purpose tokens are
+// checked with. Changing *clock moves it.
+func useClock(t *testing.T, at time.Time) *time.Time {
+	t.Helper()
+	clock := &at
+	old := now
+	now = func() time.Time { return *clock }
+	t.Cleanup(func() { now = old })
+	return clock
+}
+
+func mustCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.Code(secret, totp.Step(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func post(handler http.HandlerFunc, r *http.Request, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(data)))
+	if r != nil {
+		req = req.WithContext(r.Context())
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func expectNotThrottled(mock sqlmock.Sqlmock, keys int) {
+	for i := 0; i < keys; i++ {
+		mock.ExpectQuery("SELECT locked_until FROM login_failures").
+			WillReturnError(sql.ErrNoRows)
+	}
+}
+
+func expectLoginFailure(mock sqlmock.Sqlmock, keys int) {
+	for i := 0; i < keys; i++ {
+		mock.ExpectQuery("INSERT INTO login_failures").
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	}
+}
+
+// expectTOTPCheck expects checkTOTP to read the secret and, if accept is
+// set, to record step as the last one used.
+func expectTOTPCheck(mock sqlmock.Sqlmock, secret string, lastStep, step int64, accept bool) {
+	mock.ExpectQuery("SELECT totp_secret, totp_last_step").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(secret, lastStep))
+	if accept {
+		mock.ExpectExec("UPDATE users\\s+SET totp_last_step = \\$1").
+			WithArgs(step, mfaTestUserID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func expectClearMFAFailures(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DELETE FROM login_failures").
+		WithArgs("mfa:5").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectActiveAccount(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT state, suspended_until").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "suspended_until"}).AddRow(models.StateActive, nil))
+}
+
+func TestTOTPEnrollVerifyAndLogin(t *testing.T) {
+	useTestKeys(t)
+	clock := useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	session := withSession(httptest.NewRequest("POST", "/", nil), mfaTestUserID, 1)
+
+	// Enroll
+	mock := newMockDB(t)
+	mock.ExpectQuery("SELECT email, totp_enabled").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "totp_enabled"}).AddRow(mfaTestEmail, false))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users\\s+SET totp_secret = \\$1, totp_last_step = 0").
+		WithArgs(sqlmock.AnyArg(), mfaTestUserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").
+		WithArgs(mfaTestUserID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec("INSERT INTO recovery_codes").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	expectAudit(mock, auditTOTPEnroll)
+
+	w := post(EnrollTOTP, session, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("EnrollTOTP: status %d: %s", w.Code, w.Body)
+	}
+	var enrollment struct {
+		Secret        string   `json:"secret"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if len(enrollment.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(enrollment.RecoveryCodes), recoveryCodeCount)
+	}
+	secret := enrollment.Secret
+
+	// Verify with the current code turns 2FA on
+	verifyStep := totp.Step(*clock)
+	expectNotThrottled(mock, 2)
+	expectTOTPCheck(mock, secret, 0, verifyStep, true)
+	expectClearMFAFailures(mock)
+	mock.ExpectExec("UPDATE users\\s+SET totp_enabled = true").
+		WithArgs(mfaTestUserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditTOTPEnable)
+
+	w = post(VerifyTOTP, session, map[string]string{"code": mustCode(t, secret, *clock)})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("VerifyTOTP: status %d: %s", w.Code, w.Body)
+	}
+
+	// A correct password only gets a challenge
+	hash, err := bcrypt.GenerateFromPassword([]byte(mfaTestPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNotThrottled(mock, 2)
+	mock.ExpectQuery("SELECT id, email, COALESCE\\(password, ''\\)").
+		WithArgs(mfaTestEmail).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password"}).AddRow(mfaTestUserID, mfaTestEmail, string(hash)))
+	expectActiveAccount(mock)
+	mock.ExpectQuery("SELECT totp_enabled FROM users").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_enabled"}).AddRow(true))
+
+	w = post(Login, nil, models.LoginRequest{Email: mfaTestEmail, Password: mfaTestPassword})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login: status %d: %s", w.Code, w.Body)
+	}
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.MFARequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("Login with 2FA returned %+v, want only a challenge", challenge)
+	}
+
+	// The code used to verify cannot be used again
+	expectLoginMFAStart(mock)
+	expectTOTPCheck(mock, secret, verifyStep, 0, false)
+	mock.ExpectExec("UPDATE recovery_codes").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLoginFailure(mock, 3)
+	expectAudit(mock, auditLoginFailure)
+
+	w = post(LoginMFA, nil, map[string]string{
+		"mfa_token": challenge.MFAToken,
+		"code":      mustCode(t, secret, *clock),
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("LoginMFA with a replayed code: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The next code completes the login and clears the failures
+	*clock = clock.Add(totp.Period * time.Second)
+	loginStep := totp.Step(*clock)
+	expectLoginMFAStart(mock)
+	expectTOTPCheck(mock, secret, verifyStep, loginStep, true)
+	mock.ExpectExec("DELETE FROM login_failures").
+		WithArgs("account:" + mfaTestEmail).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectClearMFAFailures(mock)
+	expectActiveAccount(mock)
+	mock.ExpectExec("UPDATE users\\s+SET state = \\$1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE users\\s+SET deletion_scheduled_at = NULL").
+		WithArgs(mfaTestUserID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO sessions").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT role FROM users").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	expectAudit(mock, auditLoginSuccess)
+
+	w = post(LoginMFA, nil, map[string]string{
+		"mfa_token": challenge.MFAToken,
+		"code":      mustCode(t, secret, *clock),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("LoginMFA: status %d: %s", w.Code, w.Body)
+	}
+	var tokens models.TokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Fatalf("LoginMFA returned %+v, want tokens", tokens)
+	}
+}
+
+func expectLoginMFAStart(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT email FROM users").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(mfaTestEmail))
+	expectNotThrottled(mock, 3)
+}
+
+func TestLoginMFAChallengeExpires(t *testing.T) {
+	useTestKeys(t)
+	clock := useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	newMockDB(t)
+
+	token, err := signPurposeToken(mfaTestUserID, "", "mfa", mfaChallengeTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*clock = clock.Add(mfaChallengeTTL + time.Second)
+	w := post(LoginMFA, nil, map[string]string{"mfa_token": token, "code": "000000"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("LoginMFA with an expired challenge: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginMFAThrottled(t *testing.T) {
+	useTestKeys(t)
+	useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	mock := newMockDB(t)
+
+	token, err := signPurposeToken(mfaTestUserID, "", "mfa", mfaChallengeTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("SELECT email FROM users").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(mfaTestEmail))
+	expectNotThrottled(mock, 2)
+	mock.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("mfa:5").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+	expectAudit(mock, auditLoginFailure)
+
+	w := post(LoginMFA, nil, map[string]string{"mfa_token": token, "code": "000000"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("LoginMFA while locked: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestMFATokenIsNotAnAccessToken(t *testing.T) {
+	useTestKeys(t)
+	newMockDB(t)
+
+	token, err := signPurposeToken(mfaTestUserID, "", "mfa", mfaChallengeTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("MFA challenge was accepted as an access token")
+	})(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCheckTOTPRejectsConcurrentUse(t *testing.T) {
+	at := useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	mock := newMockDB(t)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request recorded the step between our read and our update
+	mock.ExpectQuery("SELECT totp_secret, totp_last_step").
+		WithArgs(mfaTestUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step"}).AddRow(secret, 0))
+	mock.ExpectExec("UPDATE users\\s+SET totp_last_step = \\$1").
+		WithArgs(totp.Step(*at), mfaTestUserID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if checkTOTP(mfaTestUserID, mustCode(t, secret, *at)) {
+		t.Fatal("checkTOTP accepted a code another request already used")
+	}
+}
+
+func TestVerifyTOTPThrottled(t *testing.T) {
+	clock := useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	session := withSession(httptest.NewRequest("POST", "/", nil), mfaTestUserID, 1)
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	// A wrong code counts against the mfa key as well as the address
+	mock := newMockDB(t)
+	expectNotThrottled(mock, 2)
+	expectTOTPCheck(mock, secret, 0, 0, false)
+	mock.ExpectQuery("INSERT INTO login_failures").
+		WithArgs("mfa:5", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	expectLoginFailure(mock, 1)
+
+	w := post(VerifyTOTP, session, map[string]string{"code": "000000"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("VerifyTOTP with a wrong code: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Once locked, even the right code is refused without being checked
+	mock.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("mfa:5").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+	expectNotThrottled(mock, 1)
+
+	w = post(VerifyTOTP, session, map[string]string{"code": mustCode(t, secret, *clock)})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("VerifyTOTP while locked: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	clock := useClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	hash, err := bcrypt.GenerateFromPassword([]byte(mfaTestPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPassword := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT email, COALESCE\\(password, ''\\)").
+			WithArgs(mfaTestUserID).
+			WillReturnRows(sqlmock.NewRows([]string{"email", "password"}).AddRow(mfaTestEmail, string(hash)))
+	}
+
+	t.Run("a code alone is not enough", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectPassword(mock)
+		expectNotThrottled(mock, 2)
+		expectLoginFailure(mock, 2)
+
+		session := withSession(httptest.NewRequest("POST", "/", nil), mfaTestUserID, 1)
+		w := post(DisableTOTP, session, map[string]string{"code": mustCode(t, secret, *clock)})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("password and code", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectPassword(mock)
+		expectNotThrottled(mock, 2)
+		mock.ExpectExec("DELETE FROM login_failures").
+			WithArgs("reauth:5").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectNotThrottled(mock, 2)
+		expectTOTPCheck(mock, secret, 0, totp.Step(*clock), true)
+		expectClearMFAFailures(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE users\\s+SET totp_enabled = false").
+			WithArgs(mfaTestUserID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM recovery_codes").
+			WithArgs(mfaTestUserID).
+			WillReturnResult(sqlmock.NewResult(0, 10))
+		mock.ExpectCommit()
+		expectAudit(mock, auditTOTPDisable)
+
+		session := withSession(httptest.NewRequest("POST", "/", nil), mfaTestUserID, 1)
+		w := post(DisableTOTP, session, map[string]string{
+			"code":     mustCode(t, secret, *clock),
+			"password": mfaTestPassword,
+		})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	})
+}
@@ -5,10 +5,25 @@ import (
 	"net/http"
 	"strings"
 
+	"match-me/models"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// AuthMiddleware only lets through requests authenticated by a session.
+// Personal access tokens are rejected; use RequireScope for routes they
+// may call.
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authenticate("", next)
+}
+
+// RequireScope lets through requests authenticated by a session or by a
+// personal access token granted scope.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return authenticate(scope, next)
+}
+
+func authenticate(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -17,23 +32,100 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+
+		if strings.HasPrefix(tokenString, apiTokenPrefix) {
+			userID, scopes, ok := authenticateAPIToken(tokenString)
+			if !ok {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			if !hasScope(scopes, scope) {
+				http.Error(w, "Token lacks the required scope", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "user_id", userID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		claims := &Claims{}
 
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		token, err := Keys.Parse(tokenString, accessTokenType, claims, jwt.WithAudience(accessTokenAudience))
 
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
+		// Tokens stop working as soon as their session is revoked
+		if !touchSession(claims.SessionID) {
+			http.Error(w, "Session revoked", http.StatusUnauthorized)
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
+		ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+		ctx = context.WithValue(ctx, "role", claims.Role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// sessionFromRequest returns the user and session of the access token r
+// carries, for routes that only sometimes need one.
+func sessionFromRequest(r *http.Request) (int, int, bool) {
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	claims := &Claims{}
+	token, err := Keys.Parse(tokenString, accessTokenType, claims, jwt.WithAudience(accessTokenAudience))
+	if err != nil || !token.Valid || !touchSession(claims.SessionID) {
+		return 0, 0, false
+	}
+	return claims.UserID, claims.SessionID, true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// roleRanks orders roles so that each one can do everything the ones
+// below it can.
+var roleRanks = map[string]int{
+	models.RoleUser:      1,
+	models.RoleModerator: 2,
+	models.RoleAdmin:     3,
+}
+
+// RequireRole only lets through sessions whose role is role or above.
+// Roles are read from the access token; changing a user's role revokes
+// their sessions so stale tokens cannot keep an old role.
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		current, _ := r.Context().Value("role").(string)
+		if roleRanks[current] < roleRanks[role] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func getUserIDFromToken(r *http.Request) (int, bool) {
 	userID, ok := r.Context().Value("user_id").(int)
 	return userID, ok
 }
+
+func getSessionIDFromToken(r *http.Request) (int, bool) {
+	sessionID, ok := r.Context().Value("session_id").(int)
+	return sessionID, ok
+}
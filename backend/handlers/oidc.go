@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+	"match-me/oidc"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	oidcStateTTL   = 10 * time.Minute
+	reauthTokenTTL = 5 * time.Minute
+)
+
+// What an OIDC flow was started for. Links and re-authentications belong
+// to the session that started them.
+const (
+	oidcPurposeLogin  = "login"
+	oidcPurposeLink   = "link"
+	oidcPurposeReauth = "reauth"
+)
+
+// OIDCProviders are the configured social login providers by name. main
+// fills it from oidc.ProvidersFromEnv().
+var OIDCProviders = map[string]*oidc.Provider{}
+
+func GetOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range OIDCProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	json.NewEncoder(w).Encode(names)
+}
+
+// OIDCLogin returns the provider URL to send the user to for logging in.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	startOIDC(w, r, oidcPurposeLogin)
+}
+
+// LinkIdentity returns the provider URL to send the user to for linking
+// the provider to their account.
+func LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	startOIDC(w, r, oidcPurposeLink)
+}
+
+// ReauthenticateOIDC returns the provider URL to send the user to for
+// confirming a sensitive change. Accounts without a password use the
+// reauth_token the callback returns in place of their password.
+func ReauthenticateOIDC(w http.ResponseWriter, r *http.Request) {
+	startOIDC(w, r, oidcPurposeReauth)
+}
+
+func startOIDC(w http.ResponseWriter, r *http.Request, purpose string) {
+	provider, ok := OIDCProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("error contacting oidc provider %s: %v", provider.Name, err)
+		http.Error(w, "Provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	var userID, sessionID sql.NullInt64
+	if purpose != oidcPurposeLogin {
+		id, _ := getUserIDFromToken(r)
+		sid, _ := getSessionIDFromToken(r)
+		userID = sql.NullInt64{Int64: int64(id), Valid: true}
+		sessionID = sql.NullInt64{Int64: int64(sid), Valid: true}
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, purpose, user_id, session_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, hashToken(state), provider.Name, nonce, verifier, purpose, userID, sessionID, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"authorization_url": authURL,
+	})
+}
+
+// OIDCCallback finishes a login, link or re-authentication started by
+// OIDCLogin, LinkIdentity or ReauthenticateOIDC. The frontend posts the
+// code and state the provider redirected back with, and for a link or
+// re-authentication the access token of the session that started it.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := OIDCProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// States are single-use
+	var nonce, verifier, purpose string
+	var stateUserID, stateSessionID sql.NullInt64
+	err := database.DB.QueryRow(`
+		DELETE FROM oidc_states
+		WHERE state_hash = $1 AND provider = $2 AND expires_at > NOW()
+		RETURNING nonce, code_verifier, purpose, user_id, session_id
+	`, hashToken(req.State), provider.Name).Scan(&nonce, &verifier, &purpose, &stateUserID, &stateSessionID)
+	if err != nil {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	// Otherwise anyone could start a link and send the provider URL to
+	// someone else, whose identity would then log in to their account
+	var userID, sessionID int
+	if purpose != oidcPurposeLogin {
+		var ok bool
+		userID, sessionID, ok = sessionFromRequest(r)
+		if !ok || int64(userID) != stateUserID.Int64 || int64(sessionID) != stateSessionID.Int64 {
+			http.Error(w, "This login was started by another session", http.StatusForbidden)
+			return
+		}
+	}
+
+	claims, err := provider.Exchange(r.Context(), req.Code, verifier, nonce)
+	if err != nil {
+		log.Printf("error completing oidc login with %s: %v", provider.Name, err)
+		http.Error(w, "Login with provider failed", http.StatusUnauthorized)
+		return
+	}
+
+	switch purpose {
+	case oidcPurposeReauth:
+		writeReauthToken(w, userID, sessionID, provider.Name, claims)
+		return
+	case oidcPurposeLink:
+		linkIdentity(w, r, userID, provider.Name, claims)
+		return
+	}
+
+	userID, status, message := findOrCreateOIDCUser(provider.Name, claims)
+	if status != 0 {
+		http.Error(w, message, status)
+		return
+	}
+
+	if isTOTPEnabled(userID) {
+		writeMFAChallenge(w, userID)
+		return
+	}
+
+	writeNewSession(w, r, userID, "oidc:"+provider.Name)
+}
+
+// findOrCreateOIDCUser returns the account for a provider identity. An
+// unknown identity is linked to the account with the same email when both
+// sides have verified it, and gets a new account otherwise. On failure it
+// returns the HTTP status and message to respond with.
+func findOrCreateOIDCUser(provider string, claims *oidc.Claims) (int, int, string) {
+	var userID int
+	err := database.DB.QueryRow(`
+		SELECT user_id FROM user_identities
+		WHERE provider = $1 AND subject = $2
+	`, provider, claims.Subject).Scan(&userID)
+	if err == nil {
+		return userID, 0, ""
+	}
+	if err != sql.ErrNoRows {
+		return 0, http.StatusInternalServerError, "Error finding account"
+	}
+
+	if !claims.EmailVerified {
+		return 0, http.StatusForbidden, "Your provider account has no verified email address"
+	}
+
+	email, err := normalizeEmail(claims.Email)
+	if err != nil {
+		return 0, http.StatusForbidden, "Your provider account has no valid email address"
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, http.StatusInternalServerError, "Error creating account"
+	}
+	defer tx.Rollback()
+
+	var verified bool
+	err = tx.QueryRow(`
+		SELECT id, email_verified FROM users
+		WHERE LOWER(email) = LOWER($1)
+	`, email).Scan(&userID, &verified)
+
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow(`
+			INSERT INTO users (email, password, email_verified)
+			VALUES ($1, NULL, true)
+			RETURNING id
+		`, email).Scan(&userID)
+		if err != nil {
+			return 0, http.StatusInternalServerError, "Error creating account"
+		}
+
+		_, err = tx.Exec(`INSERT INTO profiles (user_id) VALUES ($1)`, userID)
+		if err != nil {
+			return 0, http.StatusInternalServerError, "Error creating profile"
+		}
+
+		_, err = tx.Exec(`INSERT INTO user_bios (user_id) VALUES ($1)`, userID)
+		if err != nil {
+			return 0, http.StatusInternalServerError, "Error creating bio"
+		}
+
+	case err != nil:
+		return 0, http.StatusInternalServerError, "Error finding account"
+
+	case !verified:
+		// Linking to an unverified account would hand it to whoever
+		// registered the address first
+		return 0, http.StatusConflict, "An account with this email already exists, log in with your password to link this provider"
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+	`, userID, provider, claims.Subject, email)
+	if err != nil {
+		return 0, http.StatusConflict, "This account is already linked to another " + provider + " identity"
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, http.StatusInternalServerError, "Error creating account"
+	}
+
+	return userID, 0, ""
+}
+
+func linkIdentity(w http.ResponseWriter, r *http.Request, userID int, provider string, claims *oidc.Claims) {
+	_, err := database.DB.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+	`, userID, provider, claims.Subject, strings.TrimSpace(claims.Email))
+	if err != nil {
+		http.Error(w, "This identity or provider is already linked", http.StatusConflict)
+		return
+	}
+
+	recordAudit(r, auditIdentityLink, userID, auditTargetUser, userID, map[string]interface{}{
+		"provider": provider,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeReauthToken answers a re-authentication with a short-lived token
+// for the session that asked, if the provider identity is linked to the
+// user.
+func writeReauthToken(w http.ResponseWriter, userID, sessionID int, provider string, claims *oidc.Claims) {
+	var linked bool
+	err := database.DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_identities
+			WHERE user_id = $1 AND provider = $2 AND subject = $3
+		)
+	`, userID, provider, claims.Subject).Scan(&linked)
+	if err != nil {
+		http.Error(w, "Error confirming identity", http.StatusInternalServerError)
+		return
+	}
+
+	if !linked {
+		http.Error(w, "This identity is not linked to your account", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := signPurposeClaims(userID, &purposeClaims{
+		SessionID: sessionID,
+		Purpose:   "reauth",
+	}, reauthTokenTTL)
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"reauth_token": token,
+	})
+}
+
+func GetIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	rows, err := database.DB.Query(`
+		SELECT provider, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error fetching identities", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	identities := []models.Identity{}
+	for rows.Next() {
+		var identity models.Identity
+		var email sql.NullString
+		if err := rows.Scan(&identity.Provider, &email, &identity.CreatedAt); err != nil {
+			http.Error(w, "Error scanning identities", http.StatusInternalServerError)
+			return
+		}
+		identity.Email = email.String
+		identities = append(identities, identity)
+	}
+
+	json.NewEncoder(w).Encode(identities)
+}
+
+func UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	provider := mux.Vars(r)["provider"]
+
+	// Refuse to remove the last way to log in
+	var hasPassword bool
+	var identities int
+	err := database.DB.QueryRow(`
+		SELECT u.password IS NOT NULL, COUNT(ui.id)
+		FROM users u
+		LEFT JOIN user_identities ui ON ui.user_id = u.id
+		WHERE u.id = $1
+		GROUP BY u.id
+	`, userID).Scan(&hasPassword, &identities)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if !hasPassword && identities <= 1 {
+		http.Error(w, "Set a password before unlinking your only login provider", http.StatusConflict)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		DELETE FROM user_identities
+		WHERE user_id = $1 AND provider = $2
+	`, userID, provider)
+	if err != nil {
+		http.Error(w, "Error unlinking provider", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Provider not linked", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, auditIdentityUnlink, userID, auditTargetUser, userID, map[string]interface{}{
+		"provider": provider,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"match-me/models"
+	"match-me/oidc"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func TestFindOrCreateOIDCUserRequiresVerifiedProviderEmail(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("SELECT user_id FROM user_identities").
+		WithArgs("mock", "subject-1").
+		WillReturnError(sql.ErrNoRows)
+
+	claims := &oidc.Claims{
+		Email:            "user@example.com",
+		EmailVerified:    false,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "subject-1"},
+	}
+	userID, status, _ := findOrCreateOIDCUser("mock", claims)
+	if userID != 0 || status != http.StatusForbidden {
+		t.Fatalf("got user %d, status %d; want 0, %d", userID, status, http.StatusForbidden)
+	}
+}
+
+func TestFindOrCreateOIDCUserDoesNotLinkUnverifiedAccount(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("SELECT user_id FROM user_identities").
+		WithArgs("mock", "subject-1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, email_verified FROM users").
+		WithArgs("User@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email_verified"}).AddRow(5, false))
+	mock.ExpectRollback()
+
+	claims := &oidc.Claims{
+		Email:            "User@Example.com",
+		EmailVerified:    true,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "subject-1"},
+	}
+	userID, status, _ := findOrCreateOIDCUser("mock", claims)
+	if userID != 0 || status != http.StatusConflict {
+		t.Fatalf("got user %d, status %d; want 0, %d", userID, status, http.StatusConflict)
+	}
+}
+
+func TestFindOrCreateOIDCUserLinksVerifiedAccount(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("SELECT user_id FROM user_identities").
+		WithArgs("mock", "subject-1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, email_verified FROM users").
+		WithArgs("user@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email_verified"}).AddRow(5, true))
+	mock.ExpectExec("INSERT INTO user_identities").
+		WithArgs(5, "mock", "subject-1", "user@example.com").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	claims := &oidc.Claims{
+		Email:            "user@example.com",
+		EmailVerified:    true,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "subject-1"},
+	}
+	userID, status, message := findOrCreateOIDCUser("mock", claims)
+	if userID != 5 || status != 0 {
+		t.Fatalf("got user %d, status %d (%s); want 5, 0", userID, status, message)
+	}
+}
+
+func TestReauthenticatePasswordlessAccount(t *testing.T) {
+	useTestKeys(t)
+
+	reauth, err := signPurposeClaims(5, &purposeClaims{SessionID: 7, Purpose: "reauth"}, reauthTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, err := signPurposeToken(5, "", "mfa", mfaChallengeTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		sessionID int
+		password  string
+		token     string
+		ok        bool
+	}{
+		{"provider token from this session", 7, "", reauth, true},
+		{"provider token from another session", 8, "", reauth, false},
+		{"no token", 7, "", "", false},
+		{"any password", 7, "hunter22", "", false},
+		{"token for another purpose", 7, "", mfa, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			mock.ExpectQuery("SELECT email, COALESCE\\(password, ''\\)").
+				WithArgs(5).
+				WillReturnRows(sqlmock.NewRows([]string{"email", "password"}).AddRow("user@example.com", ""))
+
+			w := httptest.NewRecorder()
+			r := withSession(httptest.NewRequest("POST", "/", nil), 5, tt.sessionID)
+			_, ok := reauthenticate(w, r, 5, tt.password, tt.token)
+			if ok != tt.ok {
+				t.Fatalf("reauthenticate = %v, want %v", ok, tt.ok)
+			}
+			if !ok && w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestReauthTokenIsNotAnAccessToken(t *testing.T) {
+	useTestKeys(t)
+	newMockDB(t)
+
+	token, err := signPurposeClaims(5, &purposeClaims{SessionID: 7, Purpose: "reauth"}, reauthTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("reauth token was accepted as an access token")
+	})(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// postOIDCCallback posts a callback for the state a test expects to be
+// looked up, with the access token for the session given, if any.
+func postOIDCCallback(t *testing.T, userID, sessionID int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	old := OIDCProviders
+	// Nothing listens here, so reaching the provider fails fast
+	OIDCProviders = map[string]*oidc.Provider{"mock": {Name: "mock", Issuer: "http://127.0.0.1:1"}}
+	t.Cleanup(func() { OIDCProviders = old })
+
+	r := httptest.NewRequest("POST", "/api/oidc/mock/callback", strings.NewReader(`{"code":"code","state":"state"}`))
+	r = mux.SetURLVars(r, map[string]string{"provider": "mock"})
+	if userID != 0 {
+		token, err := Keys.Sign(accessTokenType, &Claims{
+			UserID:    userID,
+			SessionID: sessionID,
+			Role:      models.RoleUser,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Audience: jwt.ClaimStrings{accessTokenAudience},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	OIDCCallback(w, r)
+	return w
+}
+
+func expectOIDCState(mock sqlmock.Sqlmock, purpose string, userID, sessionID int) {
+	mock.ExpectQuery("DELETE FROM oidc_states").
+		WithArgs(hashToken("state"), "mock").
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "purpose", "user_id", "session_id"}).
+			AddRow("nonce", "verifier", purpose, userID, sessionID))
+}
+
+func expectTouchSession(mock sqlmock.Sqlmock, sessionID int) {
+	mock.ExpectExec("UPDATE sessions s").
+		WithArgs(sessionID, models.StateSuspended).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestOIDCCallbackRejectsLinkFromAnotherUser(t *testing.T) {
+	useTestKeys(t)
+	mock := newMockDB(t)
+
+	// User 5 started a link and sent the provider URL to user 6
+	expectOIDCState(mock, oidcPurposeLink, 5, 7)
+	expectTouchSession(mock, 9)
+
+	w := postOIDCCallback(t, 6, 9)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestOIDCCallbackRequiresSessionForLinkAndReauth(t *testing.T) {
+	tests := []struct {
+		name      string
+		purpose   string
+		userID    int
+		sessionID int
+		status    int
+	}{
+		{"link without a session", oidcPurposeLink, 0, 0, http.StatusForbidden},
+		{"link from another session of the same user", oidcPurposeLink, 5, 8, http.StatusForbidden},
+		{"reauth from another session of the same user", oidcPurposeReauth, 5, 8, http.StatusForbidden},
+		// Past the check the callback goes on to the provider
+		{"link from the session that started it", oidcPurposeLink, 5, 7, http.StatusUnauthorized},
+		{"reauth from the session that started it", oidcPurposeReauth, 5, 7, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestKeys(t)
+			mock := newMockDB(t)
+			expectOIDCState(mock, tt.purpose, 5, 7)
+			if tt.userID != 0 {
+				expectTouchSession(mock, tt.sessionID)
+			}
+
+			w := postOIDCCallback(t, tt.userID, tt.sessionID)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/mailer"
+	"match-me/passwords"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetTTL = time.Hour
+
+// Mailer sends account emails. main replaces it with mailer.New().
+var Mailer mailer.Mailer = &mailer.MemoryMailer{}
+
+var passwordPolicy = passwords.FromEnv()
+
+// checkPasswordPolicy writes a 400 with the policy's error code and
+// returns false if password is not acceptable.
+func checkPasswordPolicy(w http.ResponseWriter, password string) bool {
+	err := passwordPolicy.Check(password)
+	if err == nil {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(err)
+	return false
+}
+
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Answer before doing any work, so neither the response nor its
+	// timing tells whether the email is registered
+	w.WriteHeader(http.StatusAccepted)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	sendPasswordReset(req.Email)
+}
+
+// sendPasswordReset emails a reset link if address belongs to an
+// account. Failures are only logged.
+func sendPasswordReset(address string) {
+	var userID int
+	var email string
+	err := database.DB.QueryRow(`
+		SELECT id, email
+		FROM users
+		WHERE LOWER(email) = LOWER($1)
+	`, strings.TrimSpace(address)).Scan(&userID, &email)
+	if err != nil {
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("error creating password reset token: %v", err)
+		return
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO password_resets (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, userID, hashToken(token), time.Now().Add(passwordResetTTL))
+	if err != nil {
+		log.Printf("error saving password reset token: %v", err)
+		return
+	}
+
+	err = Mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your account.\n\n"+
+			"Follow this link within the next hour to choose a new password:\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.", appLink("/reset-password", token)),
+	})
+	if err != nil {
+		log.Printf("error sending password reset email: %v", err)
+	}
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !checkPasswordPolicy(w, req.Password) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the token; the used_at check makes it single-use even when two
+	// requests race
+	var userID int
+	err = tx.QueryRow(`
+		UPDATE password_resets
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(req.Token)).Scan(&userID)
+	if err != nil {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password = $1
+		WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	// Any other outstanding reset links are now stale
+	_, err = tx.Exec(`
+		UPDATE password_resets
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	// A reset may follow an account takeover, so scripts have to be
+	// given new tokens too
+	if err := revokeUserAPITokens(tx, userID); err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditPasswordReset, userID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appLink returns a frontend URL for path carrying token as a query
+// parameter. The frontend location comes from APP_URL.
+func appLink(path, token string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:5173"
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
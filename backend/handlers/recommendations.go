@@ -2,94 +2,386 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"match-me/database"
+	"match-me/matching"
+	"match-me/models"
+	"match-me/recommend"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxFeedSize caps how many ranked users a feed snapshot holds
+	maxFeedSize     = 500
+	maxFeedPageSize = 50
 )
 
+// Recommender picks the users GetRecommendations returns. main loads it
+// with recommend.FromEnv().
+var Recommender recommend.Recommender
+
+// feedPageSize is how many recommendations a page holds unless the
+// request asks for fewer or more, configured by FEED_PAGE_SIZE.
+var feedPageSize = loadFeedPageSize()
+
+// feedTTL is how long a feed's cursors keep working, configured by
+// FEED_TTL (for example "30m").
+var feedTTL = loadFeedTTL()
+
+func loadFeedPageSize() int {
+	value := os.Getenv("FEED_PAGE_SIZE")
+	if value == "" {
+		return 10
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 || size > maxFeedPageSize {
+		log.Fatalf("Invalid FEED_PAGE_SIZE %q", value)
+	}
+	return size
+}
+
+func loadFeedTTL() time.Duration {
+	value := os.Getenv("FEED_TTL")
+	if value == "" {
+		return 30 * time.Minute
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Fatalf("Invalid FEED_TTL %q", value)
+	}
+	return ttl
+}
+
+// GetRecommendations returns a page of the caller's recommendation feed,
+// best match first. Without a cursor it returns the first page of the
+// caller's live feed, ranking a new one if it has expired, has nobody
+// left to show or the caller has edited their profile since; next_cursor
+// fetches the page after, from the same ranking, until the feed expires.
 func GetRecommendations(w http.ResponseWriter, r *http.Request) {
 	userID, _ := getUserIDFromToken(r)
+	query := r.URL.Query()
+
+	limit := feedPageSize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < maxFeedPageSize {
+			limit = n
+		} else {
+			limit = maxFeedPageSize
+		}
+	}
 
+	var feedID, position int
+	var expiresAt time.Time
+	var rankAgainIfEmpty bool
+	if cursor := query.Get("cursor"); cursor != "" {
+		var ok bool
+		feedID, position, ok = parseFeedCursor(cursor)
+		if !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+
+		err := database.DB.QueryRow(`
+			SELECT expires_at
+			FROM recommendation_feeds
+			WHERE id = $1 AND user_id = $2
+		`, feedID, userID).Scan(&expiresAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error fetching recommendations", http.StatusInternalServerError)
+			return
+		}
+		if !expiresAt.After(time.Now()) {
+			http.Error(w, "Recommendations expired, start again without a cursor", http.StatusGone)
+			return
+		}
+	} else {
+		var err error
+		feedID, expiresAt, rankAgainIfEmpty, err = liveFeed(userID)
+		if err == sql.ErrNoRows {
+			feedID, expiresAt, err = createFeed(userID)
+		}
+		if err != nil {
+			http.Error(w, "Error fetching recommendations", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recommendations, nextCursor, err := feedPage(feedID, position, userID, limit)
+
+	// Everyone in the live feed has been decided on or hidden since it
+	// was ranked, so rank again in case there is someone new
+	if err == nil && rankAgainIfEmpty && len(recommendations) == 0 {
+		feedID, expiresAt, err = createFeed(userID)
+		if err == nil {
+			recommendations, nextCursor, err = feedPage(feedID, 0, userID, limit)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Error fetching recommendations", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recommendations": recommendations,
+		"next_cursor":     nextCursor,
+		"expires_at":      expiresAt,
+	})
+}
+
+// feedPage returns up to limit recommendations of feedID after position
+// and the cursor for the page after, or nil if there is none.
+func feedPage(feedID, position, userID, limit int) ([]map[string]interface{}, interface{}, error) {
+	// Users who became hidden or blocked, or who the caller has decided
+	// on or connected with, since the feed was ranked are skipped, without
+	// moving anyone else
 	rows, err := database.DB.Query(`
-		WITH user_interests AS (
-			SELECT unnest(interests) as interest
-			FROM user_bios
-			WHERE user_id = $1
-		),
-		matching_users AS (
-			SELECT DISTINCT ub.user_id
-			FROM user_bios ub
-			JOIN user_interests ui ON ui.interest = ANY(ub.interests)
-			WHERE ub.user_id != $1
-			AND ub.user_id NOT IN (
-				SELECT user_id_2 FROM connections WHERE user_id_1 = $1
-				UNION
-				SELECT user_id_1 FROM connections WHERE user_id_2 = $1
-			)
-			LIMIT 10
-		)
-		SELECT 
+		SELECT
+			i.position,
+			i.score,
+			i.reasons,
 			p.user_id,
 			p.name,
 			p.bio,
 			p.profile_picture,
 			p.location,
 			ub.interests
-		FROM matching_users mu
-		JOIN profiles p ON p.user_id = mu.user_id
-		JOIN user_bios ub ON ub.user_id = mu.user_id
-	`, userID)
-
+		FROM recommendation_feed_items i
+		JOIN recommendation_feeds f ON f.id = i.feed_id
+		JOIN users u ON u.id = i.user_id
+		JOIN profiles p ON p.user_id = i.user_id
+		JOIN user_bios ub ON ub.user_id = i.user_id
+		WHERE i.feed_id = $1 AND i.position > $2
+		AND u.email_verified
+		AND u.deletion_scheduled_at IS NULL
+		AND (u.state = $5 OR (u.state = $6 AND u.suspended_until <= NOW()))
+		AND i.user_id NOT IN (
+			SELECT blocked_id FROM blocks WHERE blocker_id = $3
+			UNION
+			SELECT blocker_id FROM blocks WHERE blocked_id = $3
+		)
+		AND i.user_id NOT IN (
+			SELECT user_id_2 FROM connections WHERE user_id_1 = $3
+			UNION
+			SELECT user_id_1 FROM connections WHERE user_id_2 = $3
+		)
+		AND i.user_id NOT IN (
+			SELECT target_id FROM decisions
+			WHERE user_id = $3 AND created_at >= f.created_at
+		)
+		ORDER BY i.position
+		LIMIT $4
+	`, feedID, position, userID, limit+1, models.StateActive, models.StateSuspended)
 	if err != nil {
-		http.Error(w, "Error fetching recommendations", http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
 	defer rows.Close()
 
-	var recommendations []map[string]interface{}
+	recommendations := []map[string]interface{}{}
+	var nextCursor interface{}
 	for rows.Next() {
-		var profile struct {
+		var item struct {
+			Position       int
+			Score          float64
+			Reasons        []byte
 			UserID         int
-			Name           string
-			Bio            string
+			Name           sql.NullString
+			Bio            sql.NullString
 			ProfilePicture sql.NullString
 			Location       sql.NullString
 			Interests      []string
 		}
 
 		err := rows.Scan(
-			&profile.UserID,
-			&profile.Name,
-			&profile.Bio,
-			&profile.ProfilePicture,
-			&profile.Location,
-			&profile.Interests,
+			&item.Position,
+			&item.Score,
+			&item.Reasons,
+			&item.UserID,
+			&item.Name,
+			&item.Bio,
+			&item.ProfilePicture,
+			&item.Location,
+			pq.Array(&item.Interests),
 		)
-
 		if err != nil {
-			http.Error(w, "Error scanning recommendations", http.StatusInternalServerError)
-			return
+			return nil, nil, err
+		}
+
+		// The extra row only tells us there is another page
+		if len(recommendations) == limit {
+			nextCursor = feedCursor(feedID, position)
+			break
+		}
+		position = item.Position
+
+		var reasons []matching.Reason
+		if err := json.Unmarshal(item.Reasons, &reasons); err != nil {
+			return nil, nil, err
+		}
+
+		// Reasons explain the score, so they are rounded the same way
+		for i := range reasons {
+			reasons[i].Similarity = roundScore(reasons[i].Similarity)
+			reasons[i].Contribution = roundScore(reasons[i].Contribution)
 		}
 
 		recommendation := map[string]interface{}{
-			"user_id":   profile.UserID,
-			"name":      profile.Name,
-			"bio":       profile.Bio,
-			"interests": profile.Interests,
+			"user_id":   item.UserID,
+			"name":      item.Name.String,
+			"bio":       item.Bio.String,
+			"interests": item.Interests,
+			"score":     roundScore(item.Score),
+			"reasons":   reasons,
 		}
 
-		if profile.ProfilePicture.Valid {
-			recommendation["profile_picture"] = profile.ProfilePicture.String
+		if item.ProfilePicture.Valid {
+			recommendation["profile_picture"] = item.ProfilePicture.String
 		}
-		if profile.Location.Valid {
-			recommendation["location"] = profile.Location.String
+		if item.Location.Valid {
+			recommendation["location"] = item.Location.String
 		}
 
 		recommendations = append(recommendations, recommendation)
 	}
+	return recommendations, nextCursor, rows.Err()
+}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"recommendations": recommendations,
+// liveFeed returns userID's newest unexpired feed and whether it was
+// ranked with anyone in it, or sql.ErrNoRows if there is none or their
+// profile or bio changed after it was ranked.
+func liveFeed(userID int) (int, time.Time, bool, error) {
+	var feedID int
+	var expiresAt time.Time
+	var hasItems bool
+	err := database.DB.QueryRow(`
+		SELECT f.id, f.expires_at,
+			EXISTS(SELECT 1 FROM recommendation_feed_items WHERE feed_id = f.id)
+		FROM recommendation_feeds f
+		WHERE f.user_id = $1 AND f.expires_at > NOW()
+		AND NOT EXISTS (
+			SELECT 1 FROM profiles WHERE user_id = $1 AND updated_at > f.created_at
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM user_bios WHERE user_id = $1 AND updated_at > f.created_at
+		)
+		ORDER BY f.created_at DESC
+		LIMIT 1
+	`, userID).Scan(&feedID, &expiresAt, &hasItems)
+	return feedID, expiresAt, hasItems, err
+}
+
+// createFeed ranks recommendations for userID and stores them as a new
+// feed, expiring their older ones so each user has one live feed.
+func createFeed(userID int) (int, time.Time, error) {
+	candidates, err := Recommender.Recommend(userID, recommend.Filter{
+		Limit:        maxFeedSize,
+		PassCooldown: passCooldown,
 	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	userIDs := make([]int64, len(candidates))
+	scores := make([]float64, len(candidates))
+	reasons := make([]string, len(candidates))
+	for i, c := range candidates {
+		userIDs[i] = int64(c.Profile.UserID)
+		scores[i] = c.Score
+
+		data, err := json.Marshal(c.Reasons)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if c.Reasons == nil {
+			data = []byte("[]")
+		}
+		reasons[i] = string(data)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE recommendation_feeds
+		SET expires_at = NOW()
+		WHERE user_id = $1 AND expires_at > NOW()
+	`, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var feedID int
+	expiresAt := time.Now().Add(feedTTL)
+	err = tx.QueryRow(`
+		INSERT INTO recommendation_feeds (user_id, expires_at)
+		VALUES ($1, $2)
+		RETURNING id
+	`, userID, expiresAt).Scan(&feedID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO recommendation_feed_items (feed_id, position, user_id, score, reasons)
+		SELECT $1, item.position, item.user_id, item.score, item.reasons::jsonb
+		FROM unnest($2::int[], $3::float8[], $4::text[])
+			WITH ORDINALITY AS item(user_id, score, reasons, position)
+	`, feedID, pq.Array(userIDs), pq.Array(scores), pq.Array(reasons))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return feedID, expiresAt, tx.Commit()
+}
+
+// feedCursor points at the page of feedID after position.
+func feedCursor(feedID, position int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", feedID, position)))
+}
+
+func parseFeedCursor(cursor string) (int, int, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var feedID, position int
+	if _, err := fmt.Sscanf(string(data), "%d:%d", &feedID, &position); err != nil {
+		return 0, 0, false
+	}
+	return feedID, position, feedID > 0 && position >= 0
+}
+
+func purgeExpiredFeeds() {
+	_, err := database.DB.Exec(`DELETE FROM recommendation_feeds WHERE expires_at <= NOW()`)
+	if err != nil {
+		log.Printf("error purging expired recommendation feeds: %v", err)
+	}
+}
+
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
 }
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"match-me/models"
+	"match-me/recommend"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const feedUserID = 5
+
+// fakeRecommender returns fixed candidates and counts how often it ranks.
+type fakeRecommender struct {
+	candidates []recommend.Candidate
+	calls      int
+}
+
+func (f *fakeRecommender) Recommend(userID int, filter recommend.Filter) ([]recommend.Candidate, error) {
+	f.calls++
+	return f.candidates, nil
+}
+
+func useRecommender(t *testing.T, candidates ...int) *fakeRecommender {
+	t.Helper()
+	fake := &fakeRecommender{}
+	for _, id := range candidates {
+		fake.candidates = append(fake.candidates, recommend.Candidate{
+			Profile: models.Profile{UserID: id},
+			Bio:     models.UserBio{UserID: id},
+			Score:   0.5,
+		})
+	}
+
+	old := Recommender
+	Recommender = fake
+	t.Cleanup(func() { Recommender = old })
+	return fake
+}
+
+func TestFeedCursor(t *testing.T) {
+	feedID, position, ok := parseFeedCursor(feedCursor(12, 30))
+	if !ok || feedID != 12 || position != 30 {
+		t.Fatalf("round trip gave %d, %d, %v; want 12, 30, true", feedID, position, ok)
+	}
+
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	for _, cursor := range []string{"", "not base64!", encode("12"), encode("a:b"), encode("0:5"), encode("-1:5"), encode("12:-1")} {
+		if _, _, ok := parseFeedCursor(cursor); ok {
+			t.Errorf("parseFeedCursor accepted %q", cursor)
+		}
+	}
+}
+
+func getRecommendations(query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/recommendations"+query, nil)
+	w := httptest.NewRecorder()
+	GetRecommendations(w, withSession(r, feedUserID, 1))
+	return w
+}
+
+func expectFeedExpiry(mock sqlmock.Sqlmock, feedID int, expiresAt time.Time) {
+	rows := sqlmock.NewRows([]string{"expires_at"})
+	if !expiresAt.IsZero() {
+		rows.AddRow(expiresAt)
+	}
+	mock.ExpectQuery("SELECT expires_at\\s+FROM recommendation_feeds").
+		WithArgs(feedID, feedUserID).
+		WillReturnRows(rows)
+}
+
+// expectFeedPage expects a page of feedID after position holding the
+// users at the given positions.
+func expectFeedPage(mock sqlmock.Sqlmock, feedID, position, limit int, positions ...int) {
+	rows := sqlmock.NewRows([]string{"position", "score", "reasons", "user_id", "name", "bio", "profile_picture", "location", "interests"})
+	for _, p := range positions {
+		rows.AddRow(p, 0.5, []byte("[]"), 100+p, "Name", "Bio", nil, nil, "{go}")
+	}
+	mock.ExpectQuery("FROM recommendation_feed_items i").
+		WithArgs(feedID, position, feedUserID, limit+1, models.StateActive, models.StateSuspended).
+		WillReturnRows(rows)
+}
+
+func expectLiveFeed(mock sqlmock.Sqlmock, feedID int, hasItems bool) {
+	rows := sqlmock.NewRows([]string{"id", "expires_at", "exists"})
+	if feedID != 0 {
+		rows.AddRow(feedID, time.Now().Add(time.Minute), hasItems)
+	}
+	mock.ExpectQuery("SELECT f.id, f.expires_at").
+		WithArgs(feedUserID).
+		WillReturnRows(rows)
+}
+
+func expectCreateFeed(mock sqlmock.Sqlmock, feedID int) {
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE recommendation_feeds\\s+SET expires_at = NOW\\(\\)").
+		WithArgs(feedUserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO recommendation_feeds").
+		WithArgs(feedUserID, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(feedID))
+	mock.ExpectExec("INSERT INTO recommendation_feed_items").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+type feedResponse struct {
+	Recommendations []struct {
+		UserID int `json:"user_id"`
+	} `json:"recommendations"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+func decodeFeed(t *testing.T, w *httptest.ResponseRecorder) feedResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response feedResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestGetRecommendationsCursorErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		expect func(sqlmock.Sqlmock)
+		status int
+	}{
+		{"malformed", "garbage", func(sqlmock.Sqlmock) {}, http.StatusBadRequest},
+		// Someone else's feed looks the same as one that never existed
+		{"another user's feed", feedCursor(7, 2), func(mock sqlmock.Sqlmock) {
+			expectFeedExpiry(mock, 7, time.Time{})
+		}, http.StatusBadRequest},
+		{"expired", feedCursor(7, 2), func(mock sqlmock.Sqlmock) {
+			expectFeedExpiry(mock, 7, time.Now().Add(-time.Second))
+		}, http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			tt.expect(mock)
+
+			if w := getRecommendations("?cursor=" + tt.cursor); w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestGetRecommendationsNextCursor(t *testing.T) {
+	t.Run("another row means another page", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectFeedExpiry(mock, 7, time.Now().Add(time.Minute))
+		expectFeedPage(mock, 7, 2, 2, 3, 5, 6)
+
+		response := decodeFeed(t, getRecommendations("?limit=2&cursor="+feedCursor(7, 2)))
+		if len(response.Recommendations) != 2 {
+			t.Fatalf("got %d recommendations, want 2", len(response.Recommendations))
+		}
+		// Skipped positions are not counted, so the next page starts after
+		// the last user shown
+		if response.NextCursor == nil || *response.NextCursor != feedCursor(7, 5) {
+			t.Fatalf("next_cursor = %v, want %s", response.NextCursor, feedCursor(7, 5))
+		}
+	})
+
+	t.Run("last page", func(t *testing.T) {
+		mock := newMockDB(t)
+		expectFeedExpiry(mock, 7, time.Now().Add(time.Minute))
+		expectFeedPage(mock, 7, 2, 2, 3, 5)
+
+		response := decodeFeed(t, getRecommendations("?limit=2&cursor="+feedCursor(7, 2)))
+		if len(response.Recommendations) != 2 || response.NextCursor != nil {
+			t.Fatalf("got %d recommendations and next_cursor %v, want 2 and none",
+				len(response.Recommendations), response.NextCursor)
+		}
+	})
+}
+
+func TestGetRecommendationsReusesLiveFeed(t *testing.T) {
+	fake := useRecommender(t, 101)
+	mock := newMockDB(t)
+	expectLiveFeed(mock, 7, true)
+	expectFeedPage(mock, 7, 0, feedPageSize, 1)
+
+	response := decodeFeed(t, getRecommendations(""))
+	if len(response.Recommendations) != 1 || fake.calls != 0 {
+		t.Fatalf("got %d recommendations after ranking %d times, want 1 from the live feed",
+			len(response.Recommendations), fake.calls)
+	}
+}
+
+func TestGetRecommendationsRanksNewFeed(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect func(sqlmock.Sqlmock)
+		calls  int
+	}{
+		{"no live feed", func(mock sqlmock.Sqlmock) {
+			expectLiveFeed(mock, 0, false)
+			expectCreateFeed(mock, 8)
+			expectFeedPage(mock, 8, 0, feedPageSize, 1)
+		}, 1},
+		{"live feed gone through", func(mock sqlmock.Sqlmock) {
+			expectLiveFeed(mock, 7, true)
+			expectFeedPage(mock, 7, 0, feedPageSize)
+			expectCreateFeed(mock, 8)
+			expectFeedPage(mock, 8, 0, feedPageSize, 1)
+		}, 1},
+		// Ranking again would find nobody either until the feed expires
+		{"live feed ranked empty", func(mock sqlmock.Sqlmock) {
+			expectLiveFeed(mock, 7, false)
+			expectFeedPage(mock, 7, 0, feedPageSize)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useRecommender(t, 101)
+			mock := newMockDB(t)
+			tt.expect(mock)
+
+			decodeFeed(t, getRecommendations(""))
+			if fake.calls != tt.calls {
+				t.Fatalf("ranked %d times, want %d", fake.calls, tt.calls)
+			}
+		})
+	}
+}
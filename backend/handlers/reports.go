@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/gorilla/mux"
+)
+
+const maxReportDetailsLength = 2000
+
+// Reasons a user can give when reporting someone.
+var reportReasons = map[string]bool{
+	"spam":                  true,
+	"harassment":            true,
+	"inappropriate_content": true,
+	"fake_profile":          true,
+	"underage":              true,
+	"other":                 true,
+}
+
+var reportStatuses = map[string]bool{
+	models.ReportOpen:      true,
+	models.ReportTriaged:   true,
+	models.ReportActioned:  true,
+	models.ReportDismissed: true,
+}
+
+// CreateReport files a report against a user, their profile or one of
+// their messages. The reported content is copied into the report so
+// that later edits or deletions do not erase it.
+func CreateReport(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		TargetType string `json:"target_type"`
+		UserID     int    `json:"user_id"`
+		MessageID  int    `json:"message_id"`
+		Reason     string `json:"reason"`
+		Details    string `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !reportReasons[req.Reason] {
+		http.Error(w, "Unknown report reason", http.StatusBadRequest)
+		return
+	}
+
+	req.Details = strings.TrimSpace(req.Details)
+	if len(req.Details) > maxReportDetailsLength {
+		http.Error(w, "Report details are too long", http.StatusBadRequest)
+		return
+	}
+
+	var snapshot interface{}
+	var messageID *int
+	reportedUserID := req.UserID
+
+	switch req.TargetType {
+	case models.ReportTargetUser, models.ReportTargetProfile:
+		var err error
+		snapshot, err = snapshotUser(req.UserID, req.TargetType == models.ReportTargetUser)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error creating report", http.StatusInternalServerError)
+			return
+		}
+
+	case models.ReportTargetMessage:
+		message, err := snapshotMessage(req.MessageID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error creating report", http.StatusInternalServerError)
+			return
+		}
+		snapshot = message
+		messageID = &message.ID
+		reportedUserID = message.SenderID
+
+	default:
+		http.Error(w, "Unknown report target type", http.StatusBadRequest)
+		return
+	}
+
+	if reportedUserID == userID {
+		http.Error(w, "Cannot report yourself", http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "Error creating report", http.StatusInternalServerError)
+		return
+	}
+
+	var report models.Report
+	err = database.DB.QueryRow(`
+		INSERT INTO reports (reporter_id, target_type, reported_user_id, message_id, reason, details, snapshot)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, status, created_at
+	`, userID, req.TargetType, reportedUserID, messageID, req.Reason, req.Details, string(data)).Scan(
+		&report.ID,
+		&report.Status,
+		&report.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, "Error creating report", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditReportCreate, userID, auditTargetReport, report.ID, map[string]interface{}{
+		"target_type":      req.TargetType,
+		"reported_user_id": reportedUserID,
+		"reason":           req.Reason,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         report.ID,
+		"status":     report.Status,
+		"created_at": report.CreatedAt,
+	})
+}
+
+// snapshotUser copies the profile and bio of userID, and their account
+// details as well when the whole user is reported.
+func snapshotUser(userID int, withAccount bool) (interface{}, error) {
+	var user models.User
+	err := database.DB.QueryRow(`
+		SELECT id, email, email_verified, role, state
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Role, &user.State)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := loadProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	bio, err := loadBio(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := map[string]interface{}{
+		"profile":  profile,
+		"bio":      bio,
+		"taken_at": time.Now(),
+	}
+	if withAccount {
+		snapshot["user"] = user
+	}
+
+	return snapshot, nil
+}
+
+// snapshotMessage loads a message that userID can see. Messages stay
+// reportable after the connection is unmatched or blocked.
+func snapshotMessage(messageID, userID int) (*models.Message, error) {
+	var message models.Message
+	err := database.DB.QueryRow(`
+		SELECT m.id, m.connection_id, m.sender_id, m.content, m.read, m.created_at
+		FROM messages m
+		JOIN connections c ON c.id = m.connection_id
+		WHERE m.id = $1
+		AND (c.user_id_1 = $2 OR c.user_id_2 = $2)
+		AND (NOT m.hidden OR m.sender_id = $2)
+	`, messageID, userID).Scan(
+		&message.ID,
+		&message.ConnectionID,
+		&message.SenderID,
+		&message.Content,
+		&message.Read,
+		&message.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// GetReports lists the moderation queue, oldest first, optionally
+// filtered by status and assignee. assignee=me selects the caller's
+// reports and assignee=none the unassigned ones.
+func GetReports(w http.ResponseWriter, r *http.Request) {
+	moderatorID, _ := getUserIDFromToken(r)
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > maxAdminPageSize {
+		limit = defaultAdminPageSize
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	status := query.Get("status")
+	if status != "" && !reportStatuses[status] {
+		http.Error(w, "Unknown report status", http.StatusBadRequest)
+		return
+	}
+
+	// 0 matches any assignee and -1 only unassigned reports
+	assigneeID := 0
+	switch assignee := query.Get("assignee"); assignee {
+	case "":
+	case "me":
+		assigneeID = moderatorID
+	case "none":
+		assigneeID = -1
+	default:
+		id, err := strconv.Atoi(assignee)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid assignee", http.StatusBadRequest)
+			return
+		}
+		assigneeID = id
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, reporter_id, target_type, reported_user_id, message_id, reason, details,
+			status, assignee_id, created_at, updated_at
+		FROM reports
+		WHERE ($1 = '' OR status = $1)
+		AND ($2 = 0 OR ($2 = -1 AND assignee_id IS NULL) OR assignee_id = $2)
+		ORDER BY created_at ASC
+		LIMIT $3 OFFSET $4
+	`, status, assigneeID, limit, offset)
+	if err != nil {
+		http.Error(w, "Error fetching reports", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		var report models.Report
+		err := rows.Scan(
+			&report.ID,
+			&report.ReporterID,
+			&report.TargetType,
+			&report.ReportedUserID,
+			&report.MessageID,
+			&report.Reason,
+			&report.Details,
+			&report.Status,
+			&report.AssigneeID,
+			&report.CreatedAt,
+			&report.UpdatedAt,
+		)
+		if err != nil {
+			http.Error(w, "Error scanning reports", http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	json.NewEncoder(w).Encode(reports)
+}
+
+// GetReport returns a report with its snapshot and notes.
+func GetReport(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	report, err := loadReport(reportID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error fetching report", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+func loadReport(reportID int) (*models.Report, error) {
+	var report models.Report
+	var snapshot []byte
+	err := database.DB.QueryRow(`
+		SELECT id, reporter_id, target_type, reported_user_id, message_id, reason, details,
+			snapshot, status, assignee_id, created_at, updated_at
+		FROM reports
+		WHERE id = $1
+	`, reportID).Scan(
+		&report.ID,
+		&report.ReporterID,
+		&report.TargetType,
+		&report.ReportedUserID,
+		&report.MessageID,
+		&report.Reason,
+		&report.Details,
+		&snapshot,
+		&report.Status,
+		&report.AssigneeID,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	report.Snapshot = snapshot
+
+	rows, err := database.DB.Query(`
+		SELECT id, author_id, body, created_at
+		FROM report_notes
+		WHERE report_id = $1
+		ORDER BY created_at ASC
+	`, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report.Notes = []models.ReportNote{}
+	for rows.Next() {
+		var note models.ReportNote
+		if err := rows.Scan(&note.ID, &note.AuthorID, &note.Body, &note.CreatedAt); err != nil {
+			return nil, err
+		}
+		report.Notes = append(report.Notes, note)
+	}
+
+	return &report, rows.Err()
+}
+
+// UpdateReport changes a report's status and assignee. Fields left out
+// of the body are kept; an assignee_id of 0 unassigns the report.
+func UpdateReport(w http.ResponseWriter, r *http.Request) {
+	moderatorID, _ := getUserIDFromToken(r)
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status     *string `json:"status"`
+		AssigneeID *int    `json:"assignee_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Status != nil && !reportStatuses[*req.Status] {
+		http.Error(w, "Unknown report status", http.StatusBadRequest)
+		return
+	}
+
+	// Reports can only be assigned to moderators
+	if req.AssigneeID != nil && *req.AssigneeID != 0 {
+		var role string
+		err := database.DB.QueryRow(`SELECT role FROM users WHERE id = $1`, *req.AssigneeID).Scan(&role)
+		if err != nil || roleRanks[role] < roleRanks[models.RoleModerator] {
+			http.Error(w, "Assignee must be a moderator", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var assigneeID *int
+	if req.AssigneeID != nil && *req.AssigneeID != 0 {
+		assigneeID = req.AssigneeID
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE reports
+		SET status = COALESCE($1, status),
+			assignee_id = CASE WHEN $2 THEN $3 ELSE assignee_id END,
+			updated_at = NOW()
+		WHERE id = $4
+	`, req.Status, req.AssigneeID != nil, assigneeID, reportID)
+	if err != nil {
+		http.Error(w, "Error updating report", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	details := map[string]interface{}{}
+	if req.Status != nil {
+		details["status"] = *req.Status
+	}
+	if req.AssigneeID != nil {
+		details["assignee_id"] = *req.AssigneeID
+	}
+	recordAudit(r, auditReportUpdate, moderatorID, auditTargetReport, reportID, details)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddReportNote attaches a moderator's note to a report.
+func AddReportNote(w http.ResponseWriter, r *http.Request) {
+	moderatorID, _ := getUserIDFromToken(r)
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		http.Error(w, "Note cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	var note models.ReportNote
+	err = database.DB.QueryRow(`
+		INSERT INTO report_notes (report_id, author_id, body)
+		SELECT id, $2, $3 FROM reports WHERE id = $1
+		RETURNING id, author_id, body, created_at
+	`, reportID, moderatorID, req.Body).Scan(&note.ID, &note.AuthorID, &note.Body, &note.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error adding note", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditReportNote, moderatorID, auditTargetReport, reportID, nil)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	accessTokenTTL = 15 * time.Minute
+	sessionTTL     = 30 * 24 * time.Hour
+)
+
+// writeNewSession logs userID in and writes the new session's tokens.
+// method describes how the user authenticated, for the audit log.
+func writeNewSession(w http.ResponseWriter, r *http.Request, userID int, method string) {
+	tokens, err := createSession(r, userID)
+	var suspended *suspensionError
+	if errors.As(err, &suspended) {
+		recordAudit(r, auditLoginFailure, 0, auditTargetUser, userID, map[string]interface{}{
+			"method": method,
+			"reason": "suspended",
+		})
+		http.Error(w, suspended.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditLoginSuccess, userID, auditTargetUser, userID, map[string]interface{}{
+		"method": method,
+	})
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// createSession starts a new session for userID on the device making
+// request r and issues its first access and refresh tokens.
+func createSession(r *http.Request, userID int) (*models.TokenResponse, error) {
+	if err := checkSuspension(userID); err != nil {
+		return nil, err
+	}
+
+	if err := reactivateOnLogin(userID); err != nil {
+		return nil, err
+	}
+
+	// Only a completed login restores an account, never a password alone
+	// on an account with 2FA
+	if err := cancelAccountDeletion(userID); err != nil {
+		return nil, err
+	}
+
+	var sessionID int
+	err := database.DB.QueryRow(`
+		INSERT INTO sessions (user_id, expires_at, user_agent, ip)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, time.Now().Add(sessionTTL), r.UserAgent(), clientIP(r)).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokens(database.DB, userID, sessionID)
+}
+
+// issueTokens stores a new refresh token for the session and signs a
+// matching access token.
+func issueTokens(db execer, userID, sessionID int) (*models.TokenResponse, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO refresh_tokens (session_id, token_hash)
+		VALUES ($1, $2)
+	`, sessionID, hashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	tokenString, err := signAccessToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TokenResponse{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func signAccessToken(userID, sessionID int) (string, error) {
+	var role string
+	err := database.DB.QueryRow(`SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		Role:      role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+		},
+	}
+
+	return Keys.Sign(accessTokenType, claims)
+}
+
+// purposeClaims are carried by single-purpose tokens such as email
+// verification links and MFA challenges. Their typ and audience keep
+// AuthMiddleware from accepting them, and keep a token made for one
+// purpose from being used for another.
+type purposeClaims struct {
+	Email string `json:"email,omitempty"`
+	// From is the account's email when the token was made, for tokens
+	// that stop working once it changes
+	From string `json:"from,omitempty"`
+	// SessionID is the session a re-authentication was done in, for
+	// tokens that only work there
+	SessionID int    `json:"sid,omitempty"`
+	Purpose   string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func signPurposeToken(userID int, email, purpose string, ttl time.Duration) (string, error) {
+	return signPurposeClaims(userID, &purposeClaims{Email: email, Purpose: purpose}, ttl)
+}
+
+func signPurposeClaims(userID int, claims *purposeClaims, ttl time.Duration) (string, error) {
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(userID),
+		Audience:  jwt.ClaimStrings{purposeAudiencePrefix + claims.Purpose},
+		ExpiresAt: jwt.NewNumericDate(now().Add(ttl)),
+	}
+	return Keys.Sign(purposeTokenType, claims)
+}
+
+// parsePurposeToken checks the signature, expiry and purpose of a token
+// made by signPurposeToken and returns its user and email.
+func parsePurposeToken(tokenString, purpose string) (int, string, error) {
+	userID, claims, err := parsePurposeClaims(tokenString, purpose)
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, claims.Email, nil
+}
+
+func parsePurposeClaims(tokenString, purpose string) (int, *purposeClaims, error) {
+	claims := &purposeClaims{}
+	token, err := Keys.Parse(tokenString, purposeTokenType, claims,
+		jwt.WithTimeFunc(now), jwt.WithAudience(purposeAudiencePrefix+purpose))
+	if err != nil || !token.Valid || claims.Purpose != purpose {
+		return 0, nil, errors.New("invalid token")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, nil, errors.New("invalid token")
+	}
+
+	return userID, claims, nil
+}
+
+// GetJWKS publishes the public keys tokens are verified with, so other
+// services can verify them too.
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(Keys.JWKS())
+}
+
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, sessionID, userID int
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		SELECT rt.id, rt.used_at, s.id, s.user_id, s.expires_at, s.revoked_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE
+	`, hashToken(req.RefreshToken)).Scan(&tokenID, &usedAt, &sessionID, &userID, &expiresAt, &revokedAt)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+
+	// A refresh token that was already rotated has been stolen or replayed,
+	// so the whole token family is revoked
+	if usedAt.Valid {
+		revokeSession(tx, sessionID)
+		tx.Commit()
+		recordAudit(r, auditRefreshReuse, 0, auditTargetSession, sessionID, map[string]interface{}{
+			"user_id": userID,
+		})
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens
+		SET used_at = NOW()
+		WHERE id = $1
+	`, tokenID)
+	if err != nil {
+		http.Error(w, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(tx, userID, sessionID)
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := getSessionIDFromToken(r)
+
+	if err := revokeSession(database.DB, sessionID); err != nil {
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// touchSession records that the session was just used and reports
+// whether it exists and has been neither revoked nor expired.
+func touchSession(sessionID int) bool {
+	result, err := database.DB.Exec(`
+		UPDATE sessions s
+		SET last_seen_at = NOW()
+		FROM users u
+		WHERE s.id = $1 AND s.revoked_at IS NULL AND s.expires_at > NOW()
+		AND u.id = s.user_id
+		AND NOT (u.state = $2 AND (u.suspended_until IS NULL OR u.suspended_until > NOW()))
+	`, sessionID, models.StateSuspended)
+	if err != nil {
+		return false
+	}
+
+	n, err := result.RowsAffected()
+	return err == nil && n > 0
+}
+
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	currentID, _ := getSessionIDFromToken(r)
+
+	rows, err := database.DB.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error fetching sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		var userAgent, ip sql.NullString
+		err := rows.Scan(&session.ID, &userAgent, &ip, &session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			http.Error(w, "Error scanning sessions", http.StatusInternalServerError)
+			return
+		}
+		session.UserAgent = userAgent.String
+		session.IP = ip.String
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	sessionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID)
+	if err != nil {
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, auditSessionRevoke, userID, auditTargetSession, sessionID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	sessionID, _ := getSessionIDFromToken(r)
+
+	if err := revokeUserSessions(database.DB, userID, sessionID); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditSessionRevokeOther, userID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func revokeSession(db execer, sessionID int) error {
+	_, err := db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+	`, sessionID)
+	return err
+}
+
+// revokeUserSessions revokes every session of userID except keepSessionID,
+// which may be zero to revoke them all.
+func revokeUserSessions(db execer, userID, keepSessionID int) error {
+	_, err := db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND id != $2 AND revoked_at IS NULL
+	`, userID, keepSessionID)
+	return err
+}
+
+// clientIP returns the address of the peer that sent r, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// randomToken returns 32 random bytes encoded for use in URLs.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of token. Tokens are random, so an
+// unsalted fast hash is enough to keep them useless if the table leaks.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
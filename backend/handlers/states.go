@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+)
+
+type suspensionError struct {
+	until *time.Time
+}
+
+func (e *suspensionError) Error() string {
+	if e.until == nil {
+		return "Account suspended"
+	}
+	return fmt.Sprintf("Account suspended until %s", e.until.Format(time.RFC3339))
+}
+
+// checkSuspension returns a *suspensionError if userID is currently
+// suspended.
+func checkSuspension(userID int) error {
+	var state string
+	var until *time.Time
+	err := database.DB.QueryRow(`
+		SELECT state, suspended_until
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&state, &until)
+	if err != nil {
+		return err
+	}
+
+	if state == models.StateSuspended && (until == nil || until.After(time.Now())) {
+		return &suspensionError{until: until}
+	}
+	return nil
+}
+
+// reactivateOnLogin ends expired suspensions and user deactivations when
+// the owner logs in.
+func reactivateOnLogin(userID int) error {
+	_, err := database.DB.Exec(`
+		UPDATE users
+		SET state = $1, suspended_until = NULL
+		WHERE id = $2
+		AND (state = $3 OR (state = $4 AND suspended_until <= NOW()))
+	`, models.StateActive, userID, models.StateDeactivated, models.StateSuspended)
+	return err
+}
+
+func isShadowBanned(userID int) bool {
+	var state string
+	err := database.DB.QueryRow(`SELECT state FROM users WHERE id = $1`, userID).Scan(&state)
+	return err == nil && state == models.StateShadowBanned
+}
+
+// DeactivateAccount hides the caller's account from everyone and signs
+// them out. Logging in again reactivates it.
+func DeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		Password    string `json:"password"`
+		ReauthToken string `json:"reauth_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := reauthenticate(w, r, userID, req.Password, req.ReauthToken); !ok {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Error deactivating account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Moderation states take precedence over deactivation
+	_, err = tx.Exec(`
+		UPDATE users
+		SET state = $1
+		WHERE id = $2 AND state = $3
+	`, models.StateDeactivated, userID, models.StateActive)
+	if err != nil {
+		http.Error(w, "Error deactivating account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		http.Error(w, "Error deactivating account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserAPITokens(tx, userID); err != nil {
+		http.Error(w, "Error deactivating account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error deactivating account", http.StatusInternalServerError)
+		return
+	}
+
+	Manager.DisconnectUser(userID)
+
+	recordAudit(r, auditAccountDeactivate, userID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
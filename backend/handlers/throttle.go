@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"match-me/database"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Failures allowed before backoff starts, per account and per IP.
+	// The IP limit is higher because many users may share an address.
+	accountFailureThreshold = 5
+	ipFailureThreshold      = 20
+
+	// The lock doubles with every failure past the threshold, up to the
+	// maximum. Failures older than the window are forgotten.
+	baseLockout   = time.Second
+	maxLockout    = 15 * time.Minute
+	failureWindow = time.Hour
+)
+
+type throttleKey struct {
+	key       string
+	threshold int
+}
+
+// loginThrottleKeys returns the keys failed logins for email from r are
+// counted under.
+func loginThrottleKeys(r *http.Request, email string) []throttleKey {
+	return []throttleKey{
+		{key: "account:" + strings.ToLower(strings.TrimSpace(email)), threshold: accountFailureThreshold},
+		{key: "ip:" + clientIP(r), threshold: ipFailureThreshold},
+	}
+}
+
+// checkLoginThrottle reports how long until any of keys is unlocked, or
+// zero if none is locked.
+func checkLoginThrottle(keys []throttleKey) time.Duration {
+	var wait time.Duration
+	for _, k := range keys {
+		var lockedUntil sql.NullTime
+		err := database.DB.QueryRow(`
+			SELECT locked_until FROM login_failures WHERE key = $1
+		`, k.key).Scan(&lockedUntil)
+		if err != nil || !lockedUntil.Valid {
+			continue
+		}
+
+		if remaining := time.Until(lockedUntil.Time); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed attempt against every key and locks
+// the ones past their threshold.
+func recordLoginFailure(keys []throttleKey) {
+	for _, k := range keys {
+		var failures int
+		err := database.DB.QueryRow(`
+			INSERT INTO login_failures (key, failures, last_failure_at)
+			VALUES ($1, 1, NOW())
+			ON CONFLICT (key) DO UPDATE
+			SET failures = CASE
+					WHEN login_failures.last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 1
+					ELSE login_failures.failures + 1
+				END,
+				last_failure_at = NOW()
+			RETURNING failures
+		`, k.key, failureWindow.Seconds()).Scan(&failures)
+		if err != nil {
+			log.Printf("error recording login failure: %v", err)
+			continue
+		}
+
+		if failures < k.threshold {
+			continue
+		}
+
+		_, err = database.DB.Exec(`
+			UPDATE login_failures
+			SET locked_until = $1
+			WHERE key = $2
+		`, time.Now().Add(lockoutFor(failures-k.threshold)), k.key)
+		if err != nil {
+			log.Printf("error locking login: %v", err)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures counted against key.
+func clearLoginFailures(key string) error {
+	_, err := database.DB.Exec(`DELETE FROM login_failures WHERE key = $1`, key)
+	return err
+}
+
+// purgeExpiredLoginFailures forgets keys whose failures are past the
+// window and which are no longer locked. Attempts against unknown emails
+// would otherwise add rows forever.
+func purgeExpiredLoginFailures() {
+	_, err := database.DB.Exec(`
+		DELETE FROM login_failures
+		WHERE last_failure_at < NOW() - $1 * INTERVAL '1 second'
+		AND (locked_until IS NULL OR locked_until <= NOW())
+	`, failureWindow.Seconds())
+	if err != nil {
+		log.Printf("error purging login failures: %v", err)
+	}
+}
+
+func lockoutFor(excess int) time.Duration {
+	lockout := float64(baseLockout) * math.Pow(2, float64(excess))
+	if lockout > float64(maxLockout) {
+		return maxLockout
+	}
+	return time.Duration(lockout)
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyPassword spends as long as checking a real password, so
+// logins for unknown emails take the same time as for known ones.
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := getUserIDFromToken(r)
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	err = database.DB.QueryRow(`SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	for _, key := range []string{"account:" + strings.ToLower(email), "mfa:" + strconv.Itoa(userID), "reauth:" + strconv.Itoa(userID)} {
+		if err := clearLoginFailures(key); err != nil {
+			http.Error(w, "Error unlocking account", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recordAudit(r, auditAdminUnlock, adminID, auditTargetUser, userID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
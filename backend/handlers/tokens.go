@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"match-me/database"
+	"match-me/models"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// apiTokenPrefix marks personal access tokens so AuthMiddleware can tell
+// them from session tokens, and so leaked ones are easy to scan for.
+const apiTokenPrefix = "mm_pat_"
+
+// Scopes a personal access token can be granted. Routes opt in to API
+// tokens with RequireScope; every other route only accepts sessions.
+var apiTokenScopes = map[string]bool{
+	"profile:read":         true,
+	"profile:write":        true,
+	"connections:read":     true,
+	"connections:write":    true,
+	"messages:read":        true,
+	"messages:write":       true,
+	"recommendations:read": true,
+}
+
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	rows, err := database.DB.Query(`
+		SELECT id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Error fetching tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		err := rows.Scan(&token.ID, &token.Name, pq.Array(&token.Scopes), &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+		if err != nil {
+			http.Error(w, "Error scanning tokens", http.StatusInternalServerError)
+			return
+		}
+		tokens = append(tokens, token)
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !apiTokenScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	token := models.APIToken{
+		Name:   req.Name,
+		Scopes: req.Scopes,
+		Token:  apiTokenPrefix + secret,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+
+	err = database.DB.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, userID, token.Name, hashToken(token.Token), pq.Array(token.Scopes), token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, auditTokenCreate, userID, auditTargetToken, token.ID, map[string]interface{}{
+		"name":   token.Name,
+		"scopes": token.Scopes,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromToken(r)
+	tokenID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE api_tokens
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, tokenID, userID)
+	if err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, auditTokenRevoke, userID, auditTargetToken, tokenID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateAPIToken looks up a personal access token, records that it
+// was used and returns its owner and scopes.
+func authenticateAPIToken(token string) (int, []string, bool) {
+	var userID int
+	var scopes []string
+	err := database.DB.QueryRow(`
+		UPDATE api_tokens t
+		SET last_used_at = NOW()
+		FROM users u
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL
+		AND (t.expires_at IS NULL OR t.expires_at > NOW())
+		AND u.id = t.user_id
+		AND NOT (u.state = $2 AND (u.suspended_until IS NULL OR u.suspended_until > NOW()))
+		RETURNING t.user_id, t.scopes
+	`, hashToken(token), models.StateSuspended).Scan(&userID, pq.Array(&scopes))
+	if err != nil {
+		return 0, nil, false
+	}
+	return userID, scopes, true
+}
+
+func revokeUserAPITokens(db execer, userID int) error {
+	_, err := db.Exec(`
+		UPDATE api_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"match-me/signing"
+)
+
+const keygenUsage = `usage: main keygen [rsa|ed25519]
+
+Prints a new token signing key as PEM. Point JWT_SIGNING_KEY at it and
+move the previous key to JWT_VERIFICATION_KEYS until old tokens expire.`
+
+func runKeygen(args []string) {
+	keyType := "ed25519"
+	if len(args) > 0 {
+		keyType = args[0]
+	}
+	if keyType != "rsa" && keyType != "ed25519" {
+		fmt.Fprintln(os.Stderr, keygenUsage)
+		os.Exit(2)
+	}
+
+	pem, err := signing.GenerateKey(keyType)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	os.Stdout.Write(pem)
+}
@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers plain-text email.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns an SMTPMailer when SMTP_HOST is set. Without it, local
+// development can set MAIL_LOG_ONLY=true to get a LogMailer instead;
+// otherwise New fails so a misconfigured server does not drop mail.
+func New() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if os.Getenv("MAIL_LOG_ONLY") != "true" {
+			return nil, errors.New("SMTP_HOST is not set (set MAIL_LOG_ONLY=true for local development)")
+		}
+		log.Println("SMTP_HOST not set, emails will only be logged")
+		return LogMailer{}, nil
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@match-me.local"
+	}
+
+	return &SMTPMailer{
+		Addr:     host + ":" + port,
+		Host:     host,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}, nil
+}
+
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// Strip line breaks so header values cannot inject extra headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.From, clean.Replace(msg.To), clean.Replace(msg.Subject), msg.Body)
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, []byte(body))
+}
+
+// tokenParam matches the token in the links emails carry.
+var tokenParam = regexp.MustCompile(`token=[^\s&]+`)
+
+// LogMailer logs each message instead of sending it, with link tokens
+// redacted since they are live credentials. It keeps nothing.
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	log.Printf("email to %s: %s\n%s", msg.To, msg.Subject, tokenParam.ReplaceAllString(msg.Body, "token=REDACTED"))
+	return nil
+}
+
+// MemoryMailer keeps every message it is asked to send, for tests.
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mutex.Lock()
+	m.messages = append(m.messages, msg)
+	m.mutex.Unlock()
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (m *MemoryMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message(nil), m.messages...)
+}
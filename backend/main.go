@@ -3,42 +3,159 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"match-me/database"
 	"match-me/handlers"
+	"match-me/mailer"
+	"match-me/matching"
+	"match-me/models"
+	"match-me/oidc"
+	"match-me/recommend"
+	"match-me/signing"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	// Operator subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "set-role":
+			runSetRole(os.Args[2:])
+			return
+		}
+	}
+
+	// Load token signing keys
+	keys, err := signing.FromEnv()
+	if err != nil {
+		log.Fatal("Invalid token signing configuration: ", err)
+	}
+	handlers.Keys = keys
+
 	// Initialize database
 	database.Init()
 	defer database.DB.Close()
 
+	// Configure outgoing email
+	mail, err := mailer.New()
+	if err != nil {
+		log.Fatal("Invalid email configuration: ", err)
+	}
+	handlers.Mailer = mail
+
+	// Configure social login providers
+	providers, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		log.Fatal("Invalid OIDC configuration: ", err)
+	}
+	handlers.OIDCProviders = providers
+
+	// Configure how recommendations are picked
+	weights, err := matching.WeightsFromEnv()
+	if err != nil {
+		log.Fatal("Invalid MATCH_WEIGHTS: ", err)
+	}
+	recommender, err := recommend.FromEnv(database.DB, weights)
+	if err != nil {
+		log.Fatal("Invalid RECOMMENDER: ", err)
+	}
+	handlers.Recommender = recommender
+
 	// Start WebSocket manager
 	go handlers.Manager.Run()
 
+	// Start erasing accounts whose deletion grace period has passed, and
+	// expired exports, audit entries and recommendation feeds
+	go handlers.RunPurger()
+
 	// Router setup
 	r := mux.NewRouter()
 
 	// Auth routes
+	r.HandleFunc("/.well-known/jwks.json", handlers.GetJWKS).Methods("GET")
 	r.HandleFunc("/api/register", handlers.Register).Methods("POST")
 	r.HandleFunc("/api/login", handlers.Login).Methods("POST")
+	r.HandleFunc("/api/verify-email", handlers.VerifyEmail).Methods("POST")
+	r.HandleFunc("/api/password/forgot", handlers.ForgotPassword).Methods("POST")
+	r.HandleFunc("/api/password/reset", handlers.ResetPassword).Methods("POST")
+	r.HandleFunc("/api/login/mfa", handlers.LoginMFA).Methods("POST")
+	r.HandleFunc("/api/oidc/providers", handlers.GetOIDCProviders).Methods("GET")
+	r.HandleFunc("/api/oidc/{provider}/login", handlers.OIDCLogin).Methods("GET")
+	r.HandleFunc("/api/oidc/{provider}/callback", handlers.OIDCCallback).Methods("POST")
+	r.HandleFunc("/api/refresh", handlers.Refresh).Methods("POST")
+	r.HandleFunc("/api/logout", handlers.AuthMiddleware(handlers.Logout)).Methods("POST")
 
 	// Protected routes
 	r.HandleFunc("/api/me", handlers.AuthMiddleware(handlers.GetMe)).Methods("GET")
-	r.HandleFunc("/api/me/profile", handlers.AuthMiddleware(handlers.GetMyProfile)).Methods("GET")
-	r.HandleFunc("/api/me/bio", handlers.AuthMiddleware(handlers.GetMyBio)).Methods("GET")
-	r.HandleFunc("/api/me/profile", handlers.AuthMiddleware(handlers.UpdateProfile)).Methods("PUT")
-	r.HandleFunc("/api/me/bio", handlers.AuthMiddleware(handlers.UpdateBio)).Methods("PUT")
-	r.HandleFunc("/api/users/{id}", handlers.AuthMiddleware(handlers.GetUser)).Methods("GET")
-	r.HandleFunc("/api/users/{id}/profile", handlers.AuthMiddleware(handlers.GetUserProfile)).Methods("GET")
-	r.HandleFunc("/api/users/{id}/bio", handlers.AuthMiddleware(handlers.GetUserBio)).Methods("GET")
-	r.HandleFunc("/api/recommendations", handlers.AuthMiddleware(handlers.GetRecommendations)).Methods("GET")
-	r.HandleFunc("/api/connections", handlers.AuthMiddleware(handlers.GetConnections)).Methods("GET")
-	r.HandleFunc("/api/connections", handlers.AuthMiddleware(handlers.CreateConnection)).Methods("POST")
-	r.HandleFunc("/api/connections/{id}/messages", handlers.AuthMiddleware(handlers.GetMessages)).Methods("GET")
-	r.HandleFunc("/ws/chat/{connectionId}", handlers.AuthMiddleware(handlers.HandleWebSocket))
+	r.HandleFunc("/api/me", handlers.AuthMiddleware(handlers.DeleteAccount)).Methods("DELETE")
+	r.HandleFunc("/api/me/deactivate", handlers.AuthMiddleware(handlers.DeactivateAccount)).Methods("POST")
+	r.HandleFunc("/api/me/verify-email", handlers.AuthMiddleware(handlers.ResendVerificationEmail)).Methods("POST")
+	r.HandleFunc("/api/me/profile", handlers.RequireScope("profile:read", handlers.GetMyProfile)).Methods("GET")
+	r.HandleFunc("/api/me/bio", handlers.RequireScope("profile:read", handlers.GetMyBio)).Methods("GET")
+	r.HandleFunc("/api/me/profile", handlers.RequireScope("profile:write", handlers.UpdateProfile)).Methods("PUT")
+	r.HandleFunc("/api/me/bio", handlers.RequireScope("profile:write", handlers.UpdateBio)).Methods("PUT")
+	r.HandleFunc("/api/users/{id}", handlers.RequireScope("profile:read", handlers.GetUser)).Methods("GET")
+	r.HandleFunc("/api/users/{id}/profile", handlers.RequireScope("profile:read", handlers.GetUserProfile)).Methods("GET")
+	r.HandleFunc("/api/users/{id}/bio", handlers.RequireScope("profile:read", handlers.GetUserBio)).Methods("GET")
+	r.HandleFunc("/api/users/{id}/block", handlers.AuthMiddleware(handlers.BlockUser)).Methods("POST")
+	r.HandleFunc("/api/users/{id}/block", handlers.AuthMiddleware(handlers.UnblockUser)).Methods("DELETE")
+	r.HandleFunc("/api/me/password", handlers.AuthMiddleware(handlers.ChangePassword)).Methods("PUT")
+	r.HandleFunc("/api/me/email", handlers.AuthMiddleware(handlers.RequestEmailChange)).Methods("PUT")
+	r.HandleFunc("/api/me/email/confirm", handlers.AuthMiddleware(handlers.ConfirmEmailChange)).Methods("POST")
+	r.HandleFunc("/api/me/identities", handlers.AuthMiddleware(handlers.GetIdentities)).Methods("GET")
+	r.HandleFunc("/api/me/identities/{provider}", handlers.AuthMiddleware(handlers.LinkIdentity)).Methods("POST")
+	r.HandleFunc("/api/me/identities/{provider}", handlers.AuthMiddleware(handlers.UnlinkIdentity)).Methods("DELETE")
+	r.HandleFunc("/api/me/reauth/{provider}", handlers.AuthMiddleware(handlers.ReauthenticateOIDC)).Methods("POST")
+	r.HandleFunc("/api/me/2fa/enroll", handlers.AuthMiddleware(handlers.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/api/me/2fa/verify", handlers.AuthMiddleware(handlers.VerifyTOTP)).Methods("POST")
+	r.HandleFunc("/api/me/2fa/disable", handlers.AuthMiddleware(handlers.DisableTOTP)).Methods("POST")
+	r.HandleFunc("/api/me/tokens", handlers.AuthMiddleware(handlers.GetAPITokens)).Methods("GET")
+	r.HandleFunc("/api/me/tokens", handlers.AuthMiddleware(handlers.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/api/me/tokens/{id}", handlers.AuthMiddleware(handlers.RevokeAPIToken)).Methods("DELETE")
+	r.HandleFunc("/api/me/sessions", handlers.AuthMiddleware(handlers.GetSessions)).Methods("GET")
+	r.HandleFunc("/api/me/sessions", handlers.AuthMiddleware(handlers.RevokeOtherSessions)).Methods("DELETE")
+	r.HandleFunc("/api/me/sessions/{id}", handlers.AuthMiddleware(handlers.RevokeSession)).Methods("DELETE")
+	r.HandleFunc("/api/me/export", handlers.AuthMiddleware(handlers.RequestDataExport)).Methods("POST")
+	r.HandleFunc("/api/me/export/{id}", handlers.AuthMiddleware(handlers.GetDataExport)).Methods("GET")
+	r.HandleFunc("/api/me/export/{id}/download", handlers.AuthMiddleware(handlers.DownloadDataExport)).Methods("GET")
+	r.HandleFunc("/api/me/blocks", handlers.AuthMiddleware(handlers.GetBlockedUsers)).Methods("GET")
+	r.HandleFunc("/api/reports", handlers.AuthMiddleware(handlers.CreateReport)).Methods("POST")
+	r.HandleFunc("/api/decisions", handlers.AuthMiddleware(handlers.Decide)).Methods("POST")
+	r.HandleFunc("/api/decisions/last", handlers.AuthMiddleware(handlers.UndoDecision)).Methods("DELETE")
+	r.HandleFunc("/api/recommendations", handlers.RequireScope("recommendations:read", handlers.GetRecommendations)).Methods("GET")
+	r.HandleFunc("/api/connections", handlers.RequireScope("connections:read", handlers.GetConnections)).Methods("GET")
+	r.HandleFunc("/api/connections", handlers.RequireScope("connections:write", handlers.CreateConnection)).Methods("POST")
+	r.HandleFunc("/api/connections/requests/incoming", handlers.RequireScope("connections:read", handlers.GetIncomingRequests)).Methods("GET")
+	r.HandleFunc("/api/connections/requests/outgoing", handlers.RequireScope("connections:read", handlers.GetOutgoingRequests)).Methods("GET")
+	r.HandleFunc("/api/connections/{id}/accept", handlers.RequireScope("connections:write", handlers.AcceptConnection)).Methods("POST")
+	r.HandleFunc("/api/connections/{id}/decline", handlers.RequireScope("connections:write", handlers.DeclineConnection)).Methods("POST")
+	r.HandleFunc("/api/connections/{id}/withdraw", handlers.RequireScope("connections:write", handlers.WithdrawConnection)).Methods("POST")
+	r.HandleFunc("/api/connections/{id}/unmatch", handlers.RequireScope("connections:write", handlers.Unmatch)).Methods("POST")
+	r.HandleFunc("/api/connections/{id}/messages", handlers.RequireScope("messages:read", handlers.GetMessages)).Methods("GET")
+	r.HandleFunc("/ws/chat/{connectionId}", handlers.RequireScope("messages:write", handlers.HandleWebSocket))
+
+	// Admin routes
+	r.HandleFunc("/api/admin/users", handlers.RequireRole(models.RoleAdmin, handlers.SearchUsers)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}", handlers.RequireRole(models.RoleAdmin, handlers.GetAdminUser)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/suspend", handlers.RequireRole(models.RoleModerator, handlers.SuspendUser)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/shadow-ban", handlers.RequireRole(models.RoleModerator, handlers.ShadowBanUser)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/reactivate", handlers.RequireRole(models.RoleModerator, handlers.ReactivateUser)).Methods("POST")
+	r.HandleFunc("/api/admin/audit", handlers.RequireRole(models.RoleAdmin, handlers.GetAuditLog)).Methods("GET")
+	r.HandleFunc("/api/admin/reports", handlers.RequireRole(models.RoleModerator, handlers.GetReports)).Methods("GET")
+	r.HandleFunc("/api/admin/reports/{id}", handlers.RequireRole(models.RoleModerator, handlers.GetReport)).Methods("GET")
+	r.HandleFunc("/api/admin/reports/{id}", handlers.RequireRole(models.RoleModerator, handlers.UpdateReport)).Methods("PUT")
+	r.HandleFunc("/api/admin/reports/{id}/notes", handlers.RequireRole(models.RoleModerator, handlers.AddReportNote)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/logout", handlers.RequireRole(models.RoleAdmin, handlers.ForceLogout)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/role", handlers.RequireRole(models.RoleAdmin, handlers.SetUserRole)).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{id}/unlock", handlers.RequireRole(models.RoleAdmin, handlers.UnlockAccount)).Methods("POST")
 
 	// CORS middleware
 	corsMiddleware := func(next http.Handler) http.Handler {
@@ -46,6 +163,7 @@ func main() {
 			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
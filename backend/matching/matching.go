@@ -0,0 +1,215 @@
+// Package matching scores how compatible two users are from their bios
+// and locations, and explains each score.
+package matching
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"match-me/models"
+)
+
+// Weights sets how much each bio field counts towards a score.
+type Weights struct {
+	Interests        float64
+	Hobbies          float64
+	MusicPreferences float64
+	FoodPreferences  float64
+	LookingFor       float64
+	Location         float64
+}
+
+// DefaultWeights favours shared interests and goals over tastes.
+func DefaultWeights() Weights {
+	return Weights{
+		Interests:        3,
+		Hobbies:          2,
+		MusicPreferences: 1,
+		FoodPreferences:  1,
+		LookingFor:       2,
+		Location:         1,
+	}
+}
+
+// User is what a score is computed from.
+type User struct {
+	Bio      models.UserBio
+	Location string
+}
+
+// Reason is something two users have in common and how much it added
+// to their score. The contributions of a score's reasons add up to it.
+//
+// A "location" reason means both users gave the same place, ignoring
+// case and surrounding spaces. Locations are free text with no
+// coordinates, so no distance is known and nearby places do not count.
+type Reason struct {
+	Field        string   `json:"field"`
+	Shared       []string `json:"shared"`
+	Similarity   float64  `json:"similarity"`
+	Contribution float64  `json:"contribution"`
+}
+
+// WeightsFromEnv reads MATCH_WEIGHTS, a comma-separated list of
+// field=weight pairs such as "interests=3,looking_for=2". Fields are named
+// as in the bio JSON, and fields left out keep their default weight.
+func WeightsFromEnv() (Weights, error) {
+	weights := DefaultWeights()
+
+	value := strings.TrimSpace(os.Getenv("MATCH_WEIGHTS"))
+	if value == "" {
+		return weights, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return weights, fmt.Errorf("invalid weight %q", pair)
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || weight < 0 {
+			return weights, fmt.Errorf("invalid weight for %s: %q", name, raw)
+		}
+
+		field := weights.field(strings.TrimSpace(name))
+		if field == nil {
+			return weights, fmt.Errorf("unknown bio field %q", name)
+		}
+		*field = weight
+	}
+
+	return weights, nil
+}
+
+func (w *Weights) field(name string) *float64 {
+	switch name {
+	case "interests":
+		return &w.Interests
+	case "hobbies":
+		return &w.Hobbies
+	case "music_preferences":
+		return &w.MusicPreferences
+	case "food_preferences":
+		return &w.FoodPreferences
+	case "looking_for":
+		return &w.LookingFor
+	case "location":
+		return &w.Location
+	}
+	return nil
+}
+
+// Normalize returns the form bio entries are compared in, so "Hiking"
+// and " hiking" are the same entry. Blank entries normalize to "".
+func Normalize(entry string) string {
+	return strings.ToLower(strings.TrimSpace(entry))
+}
+
+// Jaccard returns the size of the intersection of a and b divided by the
+// size of their union, from 0 for nothing in common to 1 for the same
+// set. Entries are compared after Normalize, duplicates and blank entries
+// are ignored, and two empty sets score 0.
+func Jaccard(a, b []string) float64 {
+	similarity, _ := jaccard(a, b)
+	return similarity
+}
+
+// jaccard is Jaccard that also returns the intersection, in b's order
+// and spelling.
+func jaccard(a, b []string) (float64, []string) {
+	set := make(map[string]bool, len(a))
+	for _, item := range a {
+		if key := Normalize(item); key != "" {
+			set[key] = true
+		}
+	}
+
+	union := len(set)
+	shared := []string{}
+	seen := make(map[string]bool, len(b))
+	for _, item := range b {
+		key := Normalize(item)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if set[key] {
+			shared = append(shared, item)
+		} else {
+			union++
+		}
+	}
+
+	if union == 0 {
+		return 0, shared
+	}
+	return float64(len(shared)) / float64(union), shared
+}
+
+// Score is the weighted mean of the Jaccard similarity of each bio field
+// and of the two locations, between 0 and 1. Bio fields neither user has
+// filled in, and locations unless both users have one, are left out
+// rather than counted as a mismatch.
+func Score(a, b User, weights Weights) float64 {
+	score, _ := Explain(a, b, weights)
+	return score
+}
+
+// Explain returns the Score of a and b along with a Reason for every
+// field that added to it, in field order.
+func Explain(a, b User, weights Weights) (float64, []Reason) {
+	type field struct {
+		name   string
+		a, b   []string
+		weight float64
+	}
+
+	fields := []field{
+		{"interests", a.Bio.Interests, b.Bio.Interests, weights.Interests},
+		{"hobbies", a.Bio.Hobbies, b.Bio.Hobbies, weights.Hobbies},
+		{"music_preferences", a.Bio.MusicPreferences, b.Bio.MusicPreferences, weights.MusicPreferences},
+		{"food_preferences", a.Bio.FoodPreferences, b.Bio.FoodPreferences, weights.FoodPreferences},
+		{"looking_for", a.Bio.LookingFor, b.Bio.LookingFor, weights.LookingFor},
+	}
+
+	// Locations are free text, so the closest we can get to distance is
+	// whether both users gave the same place; see Reason
+	locationA, locationB := strings.TrimSpace(a.Location), strings.TrimSpace(b.Location)
+	if locationA != "" && locationB != "" {
+		fields = append(fields, field{"location", []string{locationA}, []string{locationB}, weights.Location})
+	}
+
+	var total, weightSum float64
+	var reasons []Reason
+	for _, f := range fields {
+		if f.weight == 0 || (len(f.a) == 0 && len(f.b) == 0) {
+			continue
+		}
+
+		similarity, shared := jaccard(f.a, f.b)
+		total += f.weight * similarity
+		weightSum += f.weight
+
+		if similarity > 0 {
+			reasons = append(reasons, Reason{
+				Field:        f.name,
+				Shared:       shared,
+				Similarity:   similarity,
+				Contribution: f.weight * similarity,
+			})
+		}
+	}
+
+	if weightSum == 0 {
+		return 0, nil
+	}
+
+	for i := range reasons {
+		reasons[i].Contribution /= weightSum
+	}
+	return total / weightSum, reasons
+}
@@ -0,0 +1,161 @@
+package matching
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"match-me/models"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want float64
+	}{
+		{"identical", []string{"go", "chess"}, []string{"chess", "go"}, 1},
+		{"disjoint", []string{"go"}, []string{"chess"}, 0},
+		{"half", []string{"go", "chess"}, []string{"go", "hiking"}, 1.0 / 3},
+		{"both empty", nil, nil, 0},
+		{"one empty", []string{"go"}, nil, 0},
+		{"duplicates ignored", []string{"go", "go"}, []string{"go"}, 1},
+		{"case ignored", []string{"Hiking"}, []string{"hiking"}, 1},
+		{"spaces ignored", []string{" hiking "}, []string{"hiking"}, 1},
+		{"duplicates after normalizing", []string{"Hiking", "hiking"}, []string{"HIKING", "chess"}, 0.5},
+		{"blank entries ignored", []string{"go", "", "  "}, []string{"go", ""}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Jaccard(tt.a, tt.b); !almostEqual(got, tt.want) {
+				t.Errorf("Jaccard(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := Jaccard(tt.b, tt.a); !almostEqual(got, tt.want) {
+				t.Errorf("Jaccard(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJaccardSharedKeepsSecondSpelling(t *testing.T) {
+	_, shared := jaccard([]string{"hiking", "jazz"}, []string{"Jazz", " Hiking", "jazz"})
+	if want := []string{"Jazz", " Hiking"}; !reflect.DeepEqual(shared, want) {
+		t.Errorf("shared = %q, want %q", shared, want)
+	}
+}
+
+func TestExplainReasonsAddUpToScore(t *testing.T) {
+	a := User{
+		Bio: models.UserBio{
+			Interests:  []string{"go", "chess", "climbing"},
+			Hobbies:    []string{"Cooking"},
+			LookingFor: []string{"friends"},
+		},
+		Location: "Tallinn",
+	}
+	b := User{
+		Bio: models.UserBio{
+			Interests:  []string{"chess", "Go"},
+			Hobbies:    []string{"cooking", "running"},
+			LookingFor: []string{"dating"},
+		},
+		Location: " tallinn",
+	}
+
+	score, reasons := Explain(a, b, DefaultWeights())
+	if score <= 0 || score > 1 {
+		t.Fatalf("score = %v, want between 0 and 1", score)
+	}
+	if score != Score(a, b, DefaultWeights()) {
+		t.Errorf("Explain and Score disagree")
+	}
+
+	var sum float64
+	fields := []string{}
+	for _, r := range reasons {
+		sum += r.Contribution
+		fields = append(fields, r.Field)
+	}
+	if !almostEqual(sum, score) {
+		t.Errorf("contributions add up to %v, want %v", sum, score)
+	}
+	if want := []string{"interests", "hobbies", "location"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("reason fields = %q, want %q", fields, want)
+	}
+
+	// interests 2/3*3, hobbies 1/2*2, looking_for 0*2, location 1*1, over
+	// the weights of the fields either user filled in
+	want := (2.0/3*3 + 0.5*2 + 0 + 1) / (3 + 2 + 2 + 1)
+	if !almostEqual(score, want) {
+		t.Errorf("score = %v, want %v", score, want)
+	}
+}
+
+func TestExplainLocationOnly(t *testing.T) {
+	a := User{Location: "Tartu"}
+	b := User{Location: "TARTU"}
+
+	score, reasons := Explain(a, b, DefaultWeights())
+	if score != 1 {
+		t.Errorf("score = %v, want 1", score)
+	}
+	if len(reasons) != 1 || reasons[0].Field != "location" {
+		t.Errorf("reasons = %+v, want one location reason", reasons)
+	}
+
+	// A location only one user gave is left out rather than a mismatch
+	if score := Score(User{Location: "Tartu"}, User{}, DefaultWeights()); score != 0 {
+		t.Errorf("score with one location = %v, want 0", score)
+	}
+}
+
+func TestExplainSkipsZeroWeights(t *testing.T) {
+	a := User{Bio: models.UserBio{Interests: []string{"go"}, Hobbies: []string{"chess"}}}
+	b := User{Bio: models.UserBio{Interests: []string{"go"}, Hobbies: []string{"running"}}}
+
+	weights := DefaultWeights()
+	weights.Hobbies = 0
+
+	score, reasons := Explain(a, b, weights)
+	if score != 1 {
+		t.Errorf("score = %v, want 1 with hobbies ignored", score)
+	}
+	if len(reasons) != 1 || reasons[0].Field != "interests" {
+		t.Errorf("reasons = %+v, want one interests reason", reasons)
+	}
+
+	if score, reasons := Explain(a, b, Weights{}); score != 0 || reasons != nil {
+		t.Errorf("Explain with no weights = %v, %+v; want 0, nil", score, reasons)
+	}
+}
+
+func TestWeightsFromEnv(t *testing.T) {
+	t.Setenv("MATCH_WEIGHTS", " interests=5, location=0.5 ")
+	weights, err := WeightsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultWeights()
+	want.Interests = 5
+	want.Location = 0.5
+	if weights != want {
+		t.Errorf("weights = %+v, want %+v", weights, want)
+	}
+
+	for _, value := range []string{"interests", "interests=x", "interests=-1", "height=2"} {
+		t.Setenv("MATCH_WEIGHTS", value)
+		if _, err := WeightsFromEnv(); err == nil {
+			t.Errorf("MATCH_WEIGHTS=%q accepted", value)
+		}
+	}
+
+	t.Setenv("MATCH_WEIGHTS", "")
+	if weights, err := WeightsFromEnv(); err != nil || weights != DefaultWeights() {
+		t.Errorf("empty MATCH_WEIGHTS = %+v, %v; want defaults", weights, err)
+	}
+}
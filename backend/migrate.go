@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"match-me/database"
+)
+
+const migrateUsage = `usage: main migrate <command>
+
+commands:
+  up            apply every pending migration
+  down [steps]  roll back the last steps migrations (default 1)
+  to <version>  migrate up or down to version (0 rolls back everything)
+  status        list migrations and when they were applied`
+
+// runMigrate implements the migrate subcommand so operators can manage
+// the schema without starting the server.
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	database.Connect()
+	defer database.DB.Close()
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = database.MigrateUp(database.DB)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of steps: %s", args[1])
+			}
+		}
+		err = database.MigrateDown(database.DB, steps)
+
+	case "to":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			log.Fatalf("Invalid version: %s", args[1])
+		}
+		err = database.MigrateTo(database.DB, version)
+
+	case "status":
+		var statuses []database.MigrationStatus
+		statuses, err = database.Status(database.DB)
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d  %-30s  %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+}
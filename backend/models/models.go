@@ -1,13 +1,36 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
+// User roles, from least to most privileged.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Account states. Suspended accounts cannot log in until their
+// suspension ends. Shadow-banned accounts work as usual for their owner
+// but are invisible to everyone else. Deactivated accounts were hidden by
+// their owner and come back when they log in.
+const (
+	StateActive       = "active"
+	StateSuspended    = "suspended"
+	StateShadowBanned = "shadow_banned"
+	StateDeactivated  = "deactivated"
+)
+
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"-"` // Never send password in JSON
+	ID             int        `json:"id"`
+	Email          string     `json:"email"`
+	EmailVerified  bool       `json:"email_verified"`
+	Role           string     `json:"role"`
+	State          string     `json:"state"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	Password       string     `json:"-"` // Never send password in JSON
 }
 
 type Profile struct {
@@ -27,21 +50,56 @@ type UserBio struct {
 	LookingFor       []string `json:"looking_for"`
 }
 
+// Connection statuses. A connection starts as a pending request from
+// UserID1 to UserID2 and only accepted connections can be chatted on.
+// Unmatched connections are frozen: their messages are kept but no new
+// messages can be sent.
+const (
+	ConnectionPending   = "pending"
+	ConnectionAccepted  = "accepted"
+	ConnectionDeclined  = "declined"
+	ConnectionWithdrawn = "withdrawn"
+	ConnectionUnmatched = "unmatched"
+)
+
 type Connection struct {
 	ID            int       `json:"id"`
 	UserID1       int       `json:"user_id_1"`
 	UserID2       int       `json:"user_id_2"`
+	Status        string    `json:"status"`
 	LastMessage   string    `json:"last_message"`
 	LastMessageAt time.Time `json:"last_message_at"`
 	UnreadCount   int       `json:"unread_count"`
 }
 
+// Decisions a user can make about a recommended user. Likes and
+// super-likes both count towards a match.
+const (
+	DecisionLike      = "like"
+	DecisionPass      = "pass"
+	DecisionSuperLike = "super_like"
+)
+
+type Decision struct {
+	TargetID  int       `json:"target_id"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Block struct {
+	UserID         int       `json:"user_id"`
+	Name           string    `json:"name"`
+	ProfilePicture string    `json:"profile_picture"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 type Message struct {
 	ID           int       `json:"id"`
 	ConnectionID int       `json:"connection_id"`
 	SenderID     int       `json:"sender_id"`
 	Content      string    `json:"content"`
 	Read         bool      `json:"read"`
+	Hidden       bool      `json:"-"` // Sent while shadow-banned
 	CreatedAt    time.Time `json:"created_at"`
 }
 
@@ -58,4 +116,100 @@ type LoginRequest struct {
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
-}
\ No newline at end of file
+}
+
+type Session struct {
+	ID         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Data export statuses.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+type DataExport struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Token      string     `json:"token,omitempty"` // Only set when the token is created
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Report target types.
+const (
+	ReportTargetUser    = "user"
+	ReportTargetProfile = "profile"
+	ReportTargetMessage = "message"
+)
+
+// Report statuses, in the order a report usually moves through them.
+const (
+	ReportOpen      = "open"
+	ReportTriaged   = "triaged"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+type Report struct {
+	ID             int             `json:"id"`
+	ReporterID     int             `json:"reporter_id"`
+	TargetType     string          `json:"target_type"`
+	ReportedUserID *int            `json:"reported_user_id"`
+	MessageID      *int            `json:"message_id,omitempty"`
+	Reason         string          `json:"reason"`
+	Details        string          `json:"details"`
+	Snapshot       json.RawMessage `json:"snapshot,omitempty"`
+	Status         string          `json:"status"`
+	AssigneeID     *int            `json:"assignee_id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Notes          []ReportNote    `json:"notes,omitempty"`
+}
+
+type ReportNote struct {
+	ID        int       `json:"id"`
+	AuthorID  *int      `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Action     string          `json:"action"`
+	ActorID    *int            `json:"actor_id"`
+	TargetType *string         `json:"target_type"`
+	TargetID   *int            `json:"target_id"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
@@ -0,0 +1,287 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientID = "match-me-test"
+
+// mockProvider is an OpenID provider serving discovery, a JWKS and a token
+// endpoint that checks the PKCE verifier against the challenge it was sent.
+type mockProvider struct {
+	*httptest.Server
+
+	mutex       sync.Mutex
+	key         *rsa.PrivateKey
+	kid         string
+	published   []JSONWebKey
+	jwksFetches int
+	challenge   string
+	claims      jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	m := &mockProvider{}
+	m.rotateKey(t, "key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.jwksFetches++
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: m.published})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		challenge, claims := m.challenge, m.claims
+		m.mutex.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "good-code" ||
+			r.PostFormValue("client_id") != testClientID ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": m.sign(t, claims),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// rotateKey replaces the signing key and publishes only the new one.
+func (m *mockProvider) rotateKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := NewJSONWebKey(kid, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.key, m.kid, m.published = key, kid, []JSONWebKey{jwk}
+}
+
+func (m *mockProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	s, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// validClaims returns ID token claims the provider client should accept.
+func (m *mockProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"nonce":          nonce,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func (m *mockProvider) provider() *Provider {
+	return &Provider{
+		Name:        "mock",
+		Issuer:      m.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/callback",
+		Scopes:      []string{"openid", "email"},
+	}
+}
+
+// authorize starts a login like the handlers do and has the mock remember
+// the PKCE challenge the user would carry to it.
+func (m *mockProvider) authorize(t *testing.T, p *Provider, nonce string) (verifier string) {
+	t.Helper()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state", nonce, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") != nonce || q.Get("state") != "state" {
+		t.Fatalf("authorization URL is missing parameters: %s", authURL)
+	}
+
+	m.mutex.Lock()
+	m.challenge = q.Get("code_challenge")
+	m.mutex.Unlock()
+	return verifier
+}
+
+func (m *mockProvider) fetches() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.jwksFetches
+}
+
+func (m *mockProvider) setClaims(claims jwt.MapClaims) {
+	m.mutex.Lock()
+	m.claims = claims
+	m.mutex.Unlock()
+}
+
+func TestExchange(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	verifier := m.authorize(t, p, "nonce-1")
+	m.setClaims(m.validClaims("nonce-1"))
+
+	claims, err := p.Exchange(context.Background(), "good-code", verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestExchangeRejectsWrongPKCEVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	m.authorize(t, p, "nonce-1")
+	m.setClaims(m.validClaims("nonce-1"))
+
+	otherVerifier, _, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(context.Background(), "good-code", otherVerifier, "nonce-1"); err == nil {
+		t.Fatal("Exchange accepted a code with the wrong PKCE verifier")
+	}
+}
+
+func TestExchangeRejectsNonceMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	verifier := m.authorize(t, p, "nonce-1")
+	m.setClaims(m.validClaims("someone-elses-nonce"))
+
+	_, err := p.Exchange(context.Background(), "good-code", verifier, "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("Exchange error = %v, want nonce mismatch", err)
+	}
+}
+
+func TestVerifyRejectsBadClaims(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+	}{
+		{"issuer mismatch", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"audience mismatch", func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := m.validClaims("nonce-1")
+			tt.change(claims)
+
+			if _, err := p.Verify(context.Background(), m.sign(t, claims)); err == nil {
+				t.Fatal("Verify accepted the token")
+			}
+		})
+	}
+}
+
+func TestVerifyRefetchesKeysForUnknownKid(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	if _, err := p.Verify(context.Background(), m.sign(t, m.validClaims("n"))); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// Known keys are cached
+	if _, err := p.Verify(context.Background(), m.sign(t, m.validClaims("n"))); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if n := m.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	m.rotateKey(t, "key-2")
+	if _, err := p.Verify(context.Background(), m.sign(t, m.validClaims("n"))); err != nil {
+		t.Fatalf("Verify after rotation: %v", err)
+	}
+	if n := m.fetches(); n != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", n)
+	}
+
+	// A token from a key the provider never published still fails after
+	// refetching
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, m.validClaims("n"))
+	token.Header["kid"] = "key-unknown"
+	stranger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := token.SignedString(stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Verify(context.Background(), signed); err == nil {
+		t.Fatal("Verify accepted a token signed with an unknown key")
+	}
+	if n := m.fetches(); n != 3 {
+		t.Fatalf("JWKS fetched %d times, want 3", n)
+	}
+}
@@ -0,0 +1,91 @@
+// Package passwords decides whether a password is acceptable.
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxBytes is bcrypt's input limit. Longer passwords would be silently
+// truncated, so they are rejected instead.
+const MaxBytes = 72
+
+//go:embed common.txt
+var commonList string
+
+var common = loadCommon(commonList)
+
+// Error is a policy violation with a stable code the frontend can show
+// its own message for.
+type Error struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type Policy struct {
+	MinLength int
+}
+
+// FromEnv returns the policy configured by PASSWORD_MIN_LENGTH, which
+// defaults to 8 characters.
+func FromEnv() Policy {
+	policy := Policy{MinLength: 8}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+	if policy.MinLength > MaxBytes {
+		policy.MinLength = MaxBytes
+	}
+	return policy
+}
+
+// Check returns an *Error describing why password is not acceptable, or
+// nil if it is.
+func (p Policy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &Error{
+			Code:    "password_too_short",
+			Message: "Password must be at least " + strconv.Itoa(p.MinLength) + " characters",
+			Limit:   p.MinLength,
+		}
+	}
+
+	if len(password) > MaxBytes {
+		return &Error{
+			Code:    "password_too_long",
+			Message: "Password must be at most " + strconv.Itoa(MaxBytes) + " bytes",
+			Limit:   MaxBytes,
+		}
+	}
+
+	if common[strings.ToLower(password)] {
+		return &Error{
+			Code:    "password_too_common",
+			Message: "Password is too common, please choose another one",
+		}
+	}
+
+	return nil
+}
+
+func loadCommon(list string) map[string]bool {
+	set := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return set
+}
@@ -0,0 +1,83 @@
+package recommend
+
+import (
+	"math/rand"
+
+	"match-me/matching"
+)
+
+// Weighted ranks candidates by the weighted similarity of every bio
+// field and of their location, and drops those with nothing in common.
+type Weighted struct {
+	Weights matching.Weights
+}
+
+func (r Weighted) Rank(me Candidate, candidates []Candidate) []Candidate {
+	user := matching.User{Bio: me.Bio, Location: me.Profile.Location}
+
+	ranked := []Candidate{}
+	for _, c := range candidates {
+		c.Score, c.Reasons = matching.Explain(user, matching.User{Bio: c.Bio, Location: c.Profile.Location}, r.Weights)
+		if c.Score > 0 {
+			ranked = append(ranked, c)
+		}
+	}
+	sortByScore(ranked)
+	return ranked
+}
+
+// InterestOverlap ranks candidates by how many interests they share with
+// the user and drops those sharing none. The score is the share of the
+// user's interests the candidate has too, so like Weighted it is between
+// 0 and 1 and its one reason contributes all of it.
+type InterestOverlap struct{}
+
+func (InterestOverlap) Rank(me Candidate, candidates []Candidate) []Candidate {
+	interests := make(map[string]bool, len(me.Bio.Interests))
+	for _, interest := range me.Bio.Interests {
+		if key := matching.Normalize(interest); key != "" {
+			interests[key] = true
+		}
+	}
+
+	ranked := []Candidate{}
+	for _, c := range candidates {
+		shared := []string{}
+		seen := map[string]bool{}
+		for _, interest := range c.Bio.Interests {
+			key := matching.Normalize(interest)
+			if key != "" && interests[key] && !seen[key] {
+				seen[key] = true
+				shared = append(shared, interest)
+			}
+		}
+		if len(shared) == 0 {
+			continue
+		}
+
+		c.Score = float64(len(shared)) / float64(len(interests))
+		c.Reasons = []matching.Reason{{
+			Field:        "interests",
+			Shared:       shared,
+			Similarity:   matching.Jaccard(me.Bio.Interests, c.Bio.Interests),
+			Contribution: c.Score,
+		}}
+		ranked = append(ranked, c)
+	}
+	sortByScore(ranked)
+	return ranked
+}
+
+// Random ranks candidates in a random order. It is a baseline to compare
+// the other strategies against, so its recommendations have no reasons.
+type Random struct{}
+
+func (Random) Rank(me Candidate, candidates []Candidate) []Candidate {
+	ranked := make([]Candidate, len(candidates))
+	copy(ranked, candidates)
+	for i := range ranked {
+		ranked[i].Score = rand.Float64()
+	}
+	sortByScore(ranked)
+	return ranked
+}
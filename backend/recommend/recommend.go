@@ -0,0 +1,129 @@
+// Package recommend picks the users to recommend to someone. A Source
+// finds the candidates and a Ranker orders them, so new strategies only
+// need a new Ranker.
+package recommend
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"match-me/matching"
+	"match-me/models"
+)
+
+// DefaultLimit is how many recommendations are returned when a Filter
+// does not set Limit.
+const DefaultLimit = 10
+
+// Candidate is a user who could be recommended. Score and Reasons are
+// set together by the Ranker, so a recommendation is always explained by
+// what actually ranked it. Higher scores are better. Rankers that give
+// reasons score between 0 and 1, and the contributions of the reasons
+// add up to the score.
+type Candidate struct {
+	Profile models.Profile
+	Bio     models.UserBio
+	Score   float64
+	Reasons []matching.Reason
+}
+
+// Filter narrows down the candidates for a user. Users they liked are
+// always left out, and users they passed on for PassCooldown.
+type Filter struct {
+	Limit        int
+	ExcludeIDs   []int
+	PassCooldown time.Duration
+}
+
+// Recommender returns the best candidates for userID, best first.
+type Recommender interface {
+	Recommend(userID int, filter Filter) ([]Candidate, error)
+}
+
+// Source finds the candidates for userID and returns them with the
+// user's own profile and bio. Sources only apply hard rules such as
+// blocks and account state; ordering is left to the Ranker.
+type Source interface {
+	Candidates(userID int, filter Filter) (Candidate, []Candidate, error)
+}
+
+// Ranker scores and explains candidates against the user and returns
+// the ones worth recommending, best first.
+type Ranker interface {
+	Rank(me Candidate, candidates []Candidate) []Candidate
+}
+
+// Pipeline is a Recommender that ranks the candidates from Source.
+type Pipeline struct {
+	Source Source
+	Ranker Ranker
+}
+
+func (p Pipeline) Recommend(userID int, filter Filter) ([]Candidate, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultLimit
+	}
+
+	me, candidates, err := p.Source.Candidates(userID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := p.Ranker.Rank(me, candidates)
+	if len(ranked) > filter.Limit {
+		ranked = ranked[:filter.Limit]
+	}
+	return ranked, nil
+}
+
+// New returns the named strategy reading candidates from db:
+//
+//   - "weighted" scores every bio field and the location with matching.Explain
+//   - "interests" ranks by the share of the user's interests in common
+//   - "random" shuffles a random sample of eligible users, as a baseline
+func New(strategy string, db *sql.DB, weights matching.Weights) (Recommender, error) {
+	switch strategy {
+	case "weighted":
+		// Explain also scores a shared location, so users with only that
+		// in common are candidates too
+		return Pipeline{
+			Source: DBSource{DB: db, Overlap: append([]string{"location"}, bioFields...)},
+			Ranker: Weighted{Weights: weights},
+		}, nil
+	case "interests":
+		return Pipeline{
+			Source: DBSource{DB: db, Overlap: []string{"interests"}},
+			Ranker: InterestOverlap{},
+		}, nil
+	case "random":
+		return Pipeline{
+			Source: DBSource{DB: db, Sample: true},
+			Ranker: Random{},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown recommender %q", strategy)
+}
+
+// FromEnv returns the strategy named by RECOMMENDER, which defaults to
+// "weighted".
+func FromEnv(db *sql.DB, weights matching.Weights) (Recommender, error) {
+	strategy := os.Getenv("RECOMMENDER")
+	if strategy == "" {
+		strategy = "weighted"
+	}
+	return New(strategy, db, weights)
+}
+
+// sortByScore orders candidates best first. Ties go to the older account
+// so the order is stable.
+func sortByScore(candidates []Candidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Bio.UserID < candidates[j].Bio.UserID
+	})
+}
@@ -0,0 +1,229 @@
+package recommend
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"match-me/matching"
+	"match-me/models"
+)
+
+// fakeSource returns fixed candidates and remembers the filter it was
+// asked with.
+type fakeSource struct {
+	me         Candidate
+	candidates []Candidate
+	err        error
+	filter     Filter
+}
+
+func (s *fakeSource) Candidates(userID int, filter Filter) (Candidate, []Candidate, error) {
+	s.filter = filter
+	return s.me, s.candidates, s.err
+}
+
+func candidate(userID int, location string, interests ...string) Candidate {
+	return Candidate{
+		Profile: models.Profile{UserID: userID, Location: location},
+		Bio:     models.UserBio{UserID: userID, Interests: interests},
+	}
+}
+
+func userIDs(candidates []Candidate) []int {
+	ids := []int{}
+	for _, c := range candidates {
+		ids = append(ids, c.Bio.UserID)
+	}
+	return ids
+}
+
+func TestPipelineRecommend(t *testing.T) {
+	var candidates []Candidate
+	for id := 1; id <= 15; id++ {
+		candidates = append(candidates, candidate(id, "", "go"))
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"default limit", 0, DefaultLimit},
+		{"negative limit", -1, DefaultLimit},
+		{"smaller limit", 3, 3},
+		{"limit above the candidates", 50, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fakeSource{me: candidate(100, "", "go"), candidates: candidates}
+			p := Pipeline{Source: source, Ranker: InterestOverlap{}}
+
+			ranked, err := p.Recommend(100, Filter{Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranked) != tt.want {
+				t.Errorf("got %d recommendations, want %d", len(ranked), tt.want)
+			}
+			if tt.limit > 0 && source.filter.Limit != tt.limit {
+				t.Errorf("source asked for %d, want %d", source.filter.Limit, tt.limit)
+			}
+			if tt.limit <= 0 && source.filter.Limit != DefaultLimit {
+				t.Errorf("source asked for %d, want %d", source.filter.Limit, DefaultLimit)
+			}
+		})
+	}
+}
+
+func TestPipelineRecommendSourceError(t *testing.T) {
+	want := errors.New("database down")
+	p := Pipeline{Source: &fakeSource{err: want}, Ranker: Random{}}
+
+	if _, err := p.Recommend(1, Filter{}); err != want {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+}
+
+func TestRankers(t *testing.T) {
+	me := candidate(100, "Tallinn", "go", "chess", "hiking")
+	candidates := []Candidate{
+		candidate(1, "", "knitting"),
+		candidate(2, "", "Go"),
+		candidate(3, "", "go", "chess", "hiking"),
+		candidate(4, "", "chess"),
+		candidate(5, "tallinn"),
+		candidate(6, "", " CHESS ", "go"),
+	}
+
+	tests := []struct {
+		name   string
+		ranker Ranker
+		want   []int
+	}{
+		// Ties go to the lower user ID
+		{"interests", InterestOverlap{}, []int{3, 6, 2, 4}},
+		{"weighted", Weighted{Weights: matching.DefaultWeights()}, []int{3, 6, 2, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranked := tt.ranker.Rank(me, candidates)
+			if got := userIDs(ranked); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ranked %v, want %v", got, tt.want)
+			}
+			// Reasons mean the same whichever ranker gave them
+			for _, c := range ranked {
+				if c.Score <= 0 || c.Score > 1 || len(c.Reasons) == 0 {
+					t.Errorf("user %d has score %v and reasons %+v", c.Bio.UserID, c.Score, c.Reasons)
+				}
+				var sum float64
+				for _, reason := range c.Reasons {
+					sum += reason.Contribution
+				}
+				if math.Abs(sum-c.Score) > 1e-9 {
+					t.Errorf("user %d: contributions add up to %v, want %v", c.Bio.UserID, sum, c.Score)
+				}
+			}
+		})
+	}
+}
+
+func TestRankersDoNotChangeInput(t *testing.T) {
+	me := candidate(100, "", "go")
+	candidates := []Candidate{candidate(1, "", "chess"), candidate(2, "", "go")}
+
+	for _, ranker := range []Ranker{InterestOverlap{}, Weighted{Weights: matching.DefaultWeights()}, Random{}} {
+		ranker.Rank(me, candidates)
+		if got := userIDs(candidates); !reflect.DeepEqual(got, []int{1, 2}) || candidates[0].Score != 0 {
+			t.Errorf("%T changed its input to %v", ranker, got)
+		}
+	}
+}
+
+func TestRandomKeepsEveryCandidate(t *testing.T) {
+	var candidates []Candidate
+	for id := 1; id <= 20; id++ {
+		candidates = append(candidates, candidate(id, "", "unrelated"))
+	}
+
+	ranked := Random{}.Rank(candidate(100, "", "go"), candidates)
+	got := userIDs(ranked)
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, userIDs(candidates)) {
+		t.Fatalf("ranked %v, want every candidate", got)
+	}
+
+	for i, c := range ranked {
+		if c.Reasons != nil {
+			t.Errorf("user %d has reasons %+v", c.Bio.UserID, c.Reasons)
+		}
+		if c.Score < 0 || c.Score >= 1 {
+			t.Errorf("user %d has score %v", c.Bio.UserID, c.Score)
+		}
+		if i > 0 && c.Score > ranked[i-1].Score {
+			t.Errorf("user %d ranked below a lower score", c.Bio.UserID)
+		}
+	}
+}
+
+func TestSortByScore(t *testing.T) {
+	candidates := []Candidate{
+		{Bio: models.UserBio{UserID: 4}, Score: 0.5},
+		{Bio: models.UserBio{UserID: 2}, Score: 0.9},
+		{Bio: models.UserBio{UserID: 3}, Score: 0.5},
+		{Bio: models.UserBio{UserID: 1}, Score: 0.5},
+	}
+	sortByScore(candidates)
+
+	if got, want := userIDs(candidates), []int{2, 1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sorted %v, want %v", got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		strategy string
+		ranker   Ranker
+	}{
+		{"weighted", Weighted{Weights: matching.DefaultWeights()}},
+		{"interests", InterestOverlap{}},
+		{"random", Random{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			recommender, err := New(tt.strategy, nil, matching.DefaultWeights())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := recommender.(Pipeline)
+			if !ok {
+				t.Fatalf("New returned %T, want a Pipeline", recommender)
+			}
+			if !reflect.DeepEqual(p.Ranker, tt.ranker) {
+				t.Errorf("ranker = %#v, want %#v", p.Ranker, tt.ranker)
+			}
+		})
+	}
+
+	if _, err := New("popular", nil, matching.DefaultWeights()); err == nil {
+		t.Error("New accepted an unknown strategy")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("RECOMMENDER", "")
+	recommender, err := FromEnv(nil, matching.DefaultWeights())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recommender.(Pipeline).Ranker.(Weighted); !ok {
+		t.Errorf("default ranker is %T, want Weighted", recommender.(Pipeline).Ranker)
+	}
+
+	t.Setenv("RECOMMENDER", "popular")
+	if _, err := FromEnv(nil, matching.DefaultWeights()); err == nil {
+		t.Error("FromEnv accepted an unknown strategy")
+	}
+}
@@ -0,0 +1,183 @@
+package recommend
+
+import (
+	"database/sql"
+	"strings"
+
+	"match-me/models"
+
+	"github.com/lib/pq"
+)
+
+// bioFields are the user_bios columns a DBSource can require candidates
+// to share an entry in.
+var bioFields = []string{"interests", "hobbies", "music_preferences", "food_preferences", "looking_for"}
+
+// candidatesPerResult is how many candidates a DBSource reads for every
+// recommendation asked for, leaving the Ranker room to choose.
+const candidatesPerResult = 4
+
+// DBSource reads candidates from the database: verified, visible users
+// the user has no connection, block or standing decision about. If
+// Overlap names bio fields, or "location", candidates must also share an
+// entry or the location with the user in one of them. Entries are
+// compared ignoring case and surrounding spaces, as matching does.
+//
+// At most candidatesPerResult times filter.Limit candidates are read,
+// those overlapping in the most fields first and then the newest. With
+// Sample set they are instead drawn at random from every match.
+type DBSource struct {
+	DB      *sql.DB
+	Overlap []string
+	Sample  bool
+}
+
+func (s DBSource) Candidates(userID int, filter Filter) (Candidate, []Candidate, error) {
+	me := Candidate{
+		Profile: models.Profile{UserID: userID},
+		Bio:     models.UserBio{UserID: userID},
+	}
+	var location sql.NullString
+	err := s.DB.QueryRow(`
+		SELECT ub.interests, ub.hobbies, ub.music_preferences, ub.food_preferences, ub.looking_for, p.location
+		FROM user_bios ub
+		LEFT JOIN profiles p ON p.user_id = ub.user_id
+		WHERE ub.user_id = $1
+	`, userID).Scan(
+		pq.Array(&me.Bio.Interests),
+		pq.Array(&me.Bio.Hobbies),
+		pq.Array(&me.Bio.MusicPreferences),
+		pq.Array(&me.Bio.FoodPreferences),
+		pq.Array(&me.Bio.LookingFor),
+		&location,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return me, nil, err
+	}
+	me.Profile.Location = location.String
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	conditions := s.overlapConditions()
+	where, order := "", "ub.user_id DESC"
+	if len(conditions) > 0 {
+		where = "AND (" + strings.Join(conditions, " OR ") + ")"
+		order = "((" + strings.Join(conditions, ") IS TRUE)::int + ((") + ") IS TRUE)::int DESC, " + order
+	}
+	if s.Sample {
+		order = "random()"
+	}
+
+	rows, err := s.DB.Query(`
+		WITH me AS (
+			SELECT
+				normalized_entries(ub.interests) AS interests,
+				normalized_entries(ub.hobbies) AS hobbies,
+				normalized_entries(ub.music_preferences) AS music_preferences,
+				normalized_entries(ub.food_preferences) AS food_preferences,
+				normalized_entries(ub.looking_for) AS looking_for,
+				NULLIF(LOWER(BTRIM(p.location)), '') AS location
+			FROM user_bios ub
+			LEFT JOIN profiles p ON p.user_id = ub.user_id
+			WHERE ub.user_id = $1
+		)
+		SELECT
+			p.user_id,
+			p.name,
+			p.bio,
+			p.profile_picture,
+			p.location,
+			ub.interests,
+			ub.hobbies,
+			ub.music_preferences,
+			ub.food_preferences,
+			ub.looking_for
+		FROM user_bios ub
+		CROSS JOIN me
+		JOIN users u ON u.id = ub.user_id
+		JOIN profiles p ON p.user_id = ub.user_id
+		WHERE ub.user_id != $1
+		AND NOT ub.user_id = ANY(COALESCE($2::int[], '{}'))
+		`+where+`
+		AND u.email_verified
+		AND u.deletion_scheduled_at IS NULL
+		AND (u.state = $4 OR (u.state = $5 AND u.suspended_until <= NOW()))
+		AND ub.user_id NOT IN (
+			SELECT user_id_2 FROM connections WHERE user_id_1 = $1
+			UNION
+			SELECT user_id_1 FROM connections WHERE user_id_2 = $1
+		)
+		AND ub.user_id NOT IN (
+			SELECT blocked_id FROM blocks WHERE blocker_id = $1
+			UNION
+			SELECT blocker_id FROM blocks WHERE blocked_id = $1
+		)
+		AND ub.user_id NOT IN (
+			SELECT target_id FROM decisions
+			WHERE user_id = $1
+			AND (action != $7 OR created_at > NOW() - $3 * INTERVAL '1 second')
+		)
+		ORDER BY `+order+`
+		LIMIT $6
+	`, userID, pq.Array(filter.ExcludeIDs), filter.PassCooldown.Seconds(), models.StateActive, models.StateSuspended,
+		limit*candidatesPerResult, models.DecisionPass)
+	if err != nil {
+		return me, nil, err
+	}
+	defer rows.Close()
+
+	var candidates []Candidate
+	for rows.Next() {
+		var c Candidate
+		var name, bio, picture, location sql.NullString
+		err := rows.Scan(
+			&c.Bio.UserID,
+			&name,
+			&bio,
+			&picture,
+			&location,
+			pq.Array(&c.Bio.Interests),
+			pq.Array(&c.Bio.Hobbies),
+			pq.Array(&c.Bio.MusicPreferences),
+			pq.Array(&c.Bio.FoodPreferences),
+			pq.Array(&c.Bio.LookingFor),
+		)
+		if err != nil {
+			return me, nil, err
+		}
+
+		c.Profile = models.Profile{
+			UserID:         c.Bio.UserID,
+			Name:           name.String,
+			Bio:            bio.String,
+			ProfilePicture: picture.String,
+			Location:       location.String,
+		}
+		candidates = append(candidates, c)
+	}
+
+	return me, candidates, rows.Err()
+}
+
+// overlapConditions returns an SQL condition for each of s.Overlap that
+// a candidate shares an entry with the user in. Only known fields are
+// used, so the results are safe to splice into a query. Each matches an
+// index from the normalized_entries migration.
+func (s DBSource) overlapConditions() []string {
+	var conditions []string
+	for _, field := range s.Overlap {
+		if field == "location" {
+			conditions = append(conditions, "LOWER(BTRIM(p.location)) = me.location")
+			continue
+		}
+		for _, known := range bioFields {
+			if field == known {
+				conditions = append(conditions, "normalized_entries(ub."+field+") && me."+field)
+			}
+		}
+	}
+	return conditions
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"match-me/database"
+	"match-me/handlers"
+)
+
+const setRoleUsage = `usage: main set-role <email> <user|moderator|admin>
+
+Changes an account's role and signs it out everywhere. Use it to create
+the first admin, who can then manage roles through the admin API.`
+
+func runSetRole(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, setRoleUsage)
+		os.Exit(2)
+	}
+
+	database.Connect()
+	defer database.DB.Close()
+
+	if err := handlers.SetRoleByEmail(args[0], args[1]); err != nil {
+		log.Fatalf("Failed to set role: %v", err)
+	}
+	log.Printf("%s is now %s", args[0], args[1])
+}
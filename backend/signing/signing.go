@@ -0,0 +1,245 @@
+// Package signing holds the asymmetric keys tokens are signed and
+// verified with. One key signs new tokens; older keys stay available for
+// verification so keys can be rotated without logging everyone out.
+package signing
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"match-me/oidc"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type key struct {
+	kid    string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+type KeySet struct {
+	signingKey crypto.Signer
+	signing    key
+	verifying  map[string]key
+}
+
+// FromEnv loads the signing key from JWT_SIGNING_KEY and any retired keys
+// still accepted for verification from the comma-separated
+// JWT_VERIFICATION_KEYS. Each value is either a PEM file path or the PEM
+// itself.
+func FromEnv() (*KeySet, error) {
+	value := os.Getenv("JWT_SIGNING_KEY")
+	if value == "" {
+		return nil, errors.New("JWT_SIGNING_KEY is not set; generate one with `main keygen`")
+	}
+
+	block, err := readPEM(value)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY: %v", err)
+	}
+	signer, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY: %v", err)
+	}
+
+	ks, err := NewKeySet(signer)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY: %v", err)
+	}
+
+	for _, value := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		block, err := readPEM(value)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEYS: %v", err)
+		}
+		public, err := parsePublicKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEYS: %v", err)
+		}
+		if err := ks.AddVerificationKey(public); err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEYS: %v", err)
+		}
+	}
+
+	return ks, nil
+}
+
+// NewKeySet returns a key set that signs with signer, which must be an
+// RSA or Ed25519 private key.
+func NewKeySet(signer crypto.Signer) (*KeySet, error) {
+	k, err := newKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeySet{
+		signingKey: signer,
+		signing:    k,
+		verifying:  map[string]key{k.kid: k},
+	}, nil
+}
+
+// AddVerificationKey accepts tokens signed by a retired key.
+func (ks *KeySet) AddVerificationKey(public crypto.PublicKey) error {
+	k, err := newKey(public)
+	if err != nil {
+		return err
+	}
+	ks.verifying[k.kid] = k
+	return nil
+}
+
+// Sign returns claims as a token signed by the current key, with its kid
+// and typ in the header. typ names the kind of token, so that one kind
+// cannot be used in place of another.
+func (ks *KeySet) Sign(typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.kid
+	token.Header["typ"] = typ
+	return token.SignedString(ks.signingKey)
+}
+
+// Parse verifies tokenString against the key named by its kid header,
+// checks its typ header is typ and decodes it into claims.
+func (ks *KeySet) Parse(tokenString, typ string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	options = append(options, jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if t, _ := token.Header["typ"].(string); t != typ {
+			return nil, fmt.Errorf("token type %q is not %q", t, typ)
+		}
+		kid, _ := token.Header["kid"].(string)
+		k, ok := ks.verifying[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("key %q does not sign with %s", kid, token.Method.Alg())
+		}
+		return k.public, nil
+	}, options...)
+}
+
+// JWKS returns every verification key for publishing at
+// /.well-known/jwks.json.
+func (ks *KeySet) JWKS() oidc.JSONWebKeySet {
+	set := oidc.JSONWebKeySet{Keys: []oidc.JSONWebKey{}}
+	for _, k := range ks.verifying {
+		jwk, err := oidc.NewJSONWebKey(k.kid, k.public)
+		if err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// GenerateKey returns a new private key of the given type ("rsa" or
+// "ed25519") encoded as PKCS #8 PEM.
+func GenerateKey(keyType string) ([]byte, error) {
+	var private interface{}
+	var err error
+	switch keyType {
+	case "rsa":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// newKey derives the kid from a hash of the public key, so the same key
+// always gets the same kid on every replica.
+func newKey(public crypto.PublicKey) (key, error) {
+	var method jwt.SigningMethod
+	switch public.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return key{}, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", public)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return key{}, err
+	}
+	sum := sha256.Sum256(der)
+
+	return key{kid: hex.EncodeToString(sum[:8]), method: method, public: public}, nil
+}
+
+func readPEM(value string) (*pem.Block, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		var err error
+		data, err = os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return block, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	}
+	return signer, nil
+}
+
+// parsePublicKey accepts public keys as well as private keys, whose
+// public half is used.
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	signer, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
@@ -0,0 +1,251 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testType = "at+jwt"
+
+func testClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "5", Audience: jwt.ClaimStrings{"match-me"}}
+}
+
+func generatePEM(t *testing.T, keyType string) string {
+	t.Helper()
+	data, err := GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// publicPEM returns the public half of a private key PEM.
+func publicPEM(t *testing.T, privatePEM string) string {
+	t.Helper()
+	block, _ := pem.Decode([]byte(privatePEM))
+	signer, err := parsePrivateKey(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func fromEnv(t *testing.T, signingKey, verificationKeys string) *KeySet {
+	t.Helper()
+	t.Setenv("JWT_SIGNING_KEY", signingKey)
+	t.Setenv("JWT_VERIFICATION_KEYS", verificationKeys)
+	ks, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	return ks
+}
+
+func sign(t *testing.T, ks *KeySet, typ string) string {
+	t.Helper()
+	claims := testClaims()
+	token, err := ks.Sign(typ, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func parse(ks *KeySet, token, typ string, options ...jwt.ParserOption) error {
+	_, err := ks.Parse(token, typ, &jwt.RegisteredClaims{}, options...)
+	return err
+}
+
+func TestFromEnvKeyTypes(t *testing.T) {
+	for _, tt := range []struct {
+		keyType string
+		alg     string
+	}{
+		{"rsa", "RS256"},
+		{"ed25519", "EdDSA"},
+	} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			privatePEM := generatePEM(t, tt.keyType)
+
+			// The key can be given inline or as a path
+			path := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(path, []byte(privatePEM), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, value := range []string{privatePEM, path} {
+				ks := fromEnv(t, value, "")
+				token := sign(t, ks, testType)
+
+				parsed, err := ks.Parse(token, testType, &jwt.RegisteredClaims{}, jwt.WithAudience("match-me"))
+				if err != nil {
+					t.Fatalf("Parse: %v", err)
+				}
+				if parsed.Method.Alg() != tt.alg {
+					t.Errorf("signed with %s, want %s", parsed.Method.Alg(), tt.alg)
+				}
+				if parsed.Header["kid"] != ks.signing.kid {
+					t.Errorf("kid = %v, want %s", parsed.Header["kid"], ks.signing.kid)
+				}
+			}
+		})
+	}
+}
+
+func TestFromEnvPKCS1(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+
+	ks := fromEnv(t, string(privatePEM), "")
+	if err := parse(ks, sign(t, ks, testType), testType); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+}
+
+func TestFromEnvErrors(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	tests := []struct {
+		name             string
+		signingKey       string
+		verificationKeys string
+	}{
+		{"no signing key", "", ""},
+		{"missing file", filepath.Join(t.TempDir(), "missing.pem"), ""},
+		{"not PEM", "-----BEGIN nonsense", ""},
+		{"unsupported key type", ecdsaPEM, ""},
+		{"bad verification key", generatePEM(t, "ed25519"), "-----BEGIN nonsense"},
+		{"unsupported verification key", generatePEM(t, "ed25519"), ecdsaPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SIGNING_KEY", tt.signingKey)
+			t.Setenv("JWT_VERIFICATION_KEYS", tt.verificationKeys)
+			if _, err := FromEnv(); err == nil {
+				t.Fatal("FromEnv accepted the configuration")
+			}
+		})
+	}
+}
+
+func TestKidIsStable(t *testing.T) {
+	privatePEM := generatePEM(t, "ed25519")
+	a := fromEnv(t, privatePEM, "")
+	b := fromEnv(t, privatePEM, "")
+	if a.signing.kid != b.signing.kid {
+		t.Fatalf("kids %s and %s differ for the same key", a.signing.kid, b.signing.kid)
+	}
+
+	other := fromEnv(t, generatePEM(t, "ed25519"), "")
+	if a.signing.kid == other.signing.kid {
+		t.Fatal("different keys got the same kid")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	oldPEM := generatePEM(t, "rsa")
+	newPEM := generatePEM(t, "ed25519")
+
+	old := fromEnv(t, oldPEM, "")
+	oldToken := sign(t, old, testType)
+
+	// After rotating, tokens from the retired key are still accepted only
+	// while it is listed, as a public or a private key
+	for _, retired := range []string{publicPEM(t, oldPEM), oldPEM} {
+		rotated := fromEnv(t, newPEM, " , "+retired)
+		if err := parse(rotated, oldToken, testType); err != nil {
+			t.Fatalf("token from the retired key rejected: %v", err)
+		}
+		if err := parse(rotated, sign(t, rotated, testType), testType); err != nil {
+			t.Fatalf("token from the new key rejected: %v", err)
+		}
+		if n := len(rotated.JWKS().Keys); n != 2 {
+			t.Errorf("JWKS has %d keys, want 2", n)
+		}
+	}
+
+	unlisted := fromEnv(t, newPEM, "")
+	if err := parse(unlisted, oldToken, testType); err == nil {
+		t.Fatal("token from a key no longer listed was accepted")
+	}
+	if n := len(unlisted.JWKS().Keys); n != 1 {
+		t.Errorf("JWKS has %d keys, want 1", n)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	rsaKeys := fromEnv(t, generatePEM(t, "rsa"), "")
+	edPEM := generatePEM(t, "ed25519")
+	edKeys := fromEnv(t, edPEM, "")
+	token := sign(t, edKeys, testType)
+
+	if err := parse(edKeys, token, "purpose+jwt"); err == nil || !strings.Contains(err.Error(), "token type") {
+		t.Errorf("wrong typ: err = %v", err)
+	}
+	if err := parse(edKeys, token, testType, jwt.WithAudience("match-me:reauth")); err == nil {
+		t.Error("wrong audience accepted")
+	}
+	if err := parse(rsaKeys, token, testType); err == nil {
+		t.Error("token from an unknown key accepted")
+	}
+
+	// A token naming a known kid but signed with another algorithm
+	mixed := fromEnv(t, edPEM, "")
+	if err := mixed.AddVerificationKey(rsaKeys.signing.public); err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, testClaims())
+	forged.Header["kid"] = rsaKeys.signing.kid
+	forged.Header["typ"] = testType
+	signed, err := forged.SignedString(mixed.signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parse(mixed, signed, testType); err == nil {
+		t.Error("token signed with another key's algorithm accepted")
+	}
+
+	// Unsigned tokens are never accepted
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims())
+	none.Header["kid"] = edKeys.signing.kid
+	none.Header["typ"] = testType
+	unsigned, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parse(edKeys, unsigned, testType); err == nil {
+		t.Error("unsigned token accepted")
+	}
+}
+
+func TestGenerateKeyUnknownType(t *testing.T) {
+	if _, err := GenerateKey("dsa"); err == nil {
+		t.Fatal("GenerateKey accepted an unknown type")
+	}
+}